@@ -0,0 +1,105 @@
+// Command fakehub is a stand-in WebSub hub, for checking that a blog running
+// on the development server pings its hubs. Add its address, for example
+// "http://localhost:8090/", to the blog's hubs, then save a visible post.
+//
+// Each publish ping is logged, and the topic fetched to show what the hub
+// would send subscribers. With -fail n, the first n pings are refused with a
+// server error, to exercise the task queue's retries.
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+)
+
+var (
+	addr  = flag.String("addr", "localhost:8090", "address to listen on")
+	fail  = flag.Int("fail", 0, "refuse this many pings before accepting them")
+	fetch = flag.Bool("fetch", true, "fetch the topic after each ping")
+
+	mu    sync.Mutex
+	pings int
+)
+
+func main() {
+	flag.Parse()
+	http.HandleFunc("/", hub)
+	log.Printf("Fake hub listening on http://%s/", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func hub(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Hubs only accept POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mode, topic := r.FormValue("hub.mode"), r.FormValue("hub.url")
+	if mode != "publish" || topic == "" {
+		log.Printf("Bad request: hub.mode=%q hub.url=%q", mode, topic)
+		http.Error(w, "Expected hub.mode=publish and hub.url", http.StatusBadRequest)
+		return
+	}
+
+	mu.Lock()
+	pings++
+	n := pings
+	mu.Unlock()
+
+	if n <= *fail {
+		log.Printf("Ping %d for %s: refusing, as asked", n, topic)
+		http.Error(w, "Failing on purpose", http.StatusServiceUnavailable)
+		return
+	}
+
+	log.Printf("Ping %d for %s: accepted", n, topic)
+	w.WriteHeader(http.StatusNoContent)
+
+	if *fetch {
+		go fetchTopic(topic)
+	}
+}
+
+// fetchTopic lists the entries in the topic feed, as a subscriber would
+// receive them
+func fetchTopic(topic string) {
+	resp, err := http.Get(topic)
+	if err != nil {
+		log.Printf("Fetching %s: %v", topic, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var feed struct {
+		Entries []struct {
+			Title   string `xml:"title"`
+			Updated string `xml:"updated"`
+		} `xml:"entry"`
+		Links []struct {
+			Rel  string `xml:"rel,attr"`
+			Href string `xml:"href,attr"`
+		} `xml:"link"`
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err == nil {
+		err = xml.Unmarshal(body, &feed)
+	}
+	if err != nil {
+		log.Printf("Reading %s: %v", topic, err)
+		return
+	}
+
+	for _, l := range feed.Links {
+		if l.Rel == "hub" {
+			log.Printf("  advertises hub %s", l.Href)
+		}
+	}
+	for _, e := range feed.Entries {
+		log.Printf("  %s  %s", e.Updated, e.Title)
+	}
+}
@@ -0,0 +1,259 @@
+// Command mdsync copies posts between a Dinghy blog and a directory of
+// markdown files with front matter, as used by Jekyll and Hugo. It needs an
+// API token with admin scope, which can be created on the blog's admin page.
+//
+//	mdsync -site URL -token TOKEN export DIR
+//	mdsync -site URL -token TOKEN [-n] import DIR
+//
+// export writes each post to DIR/posts, and import uploads the .md and
+// .markdown files under DIR. Either DIR may instead be a .zip file. Posts
+// keep the IDs in their front matter; one whose ID is taken by a different
+// post is reported as a conflict and not imported. With -n, nothing is
+// imported, and the report shows what would be.
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	site   = flag.String("site", "", "blog URL, e.g. https://example.appspot.com")
+	token  = flag.String("token", os.Getenv("DINGHY_TOKEN"), "API token with admin scope (default $DINGHY_TOKEN)")
+	dryRun = flag.Bool("n", false, "dry run: report what would be imported")
+)
+
+// The report returned by "/import"
+type report struct {
+	DryRun    bool
+	Imported  int
+	Skipped   int
+	Conflicts int
+	Items     []struct {
+		Title  string
+		Date   time.Time
+		Hidden bool
+		File   string
+		NewURL string
+		Skip   string
+	}
+}
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: mdsync -site URL -token TOKEN export DIR\n")
+		fmt.Fprintf(os.Stderr, "       mdsync -site URL -token TOKEN [-n] import DIR\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *site == "" || *token == "" || flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, dir := flag.Arg(0), flag.Arg(1); cmd {
+	case "export":
+		err = export(dir)
+	case "import":
+		var r *report
+		if r, err = upload(dir); err == nil {
+			print(r)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// request makes an authenticated request, returning the response body
+func request(method, path, contentType string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(*site, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+// export downloads the blog's posts, unpacking them into dir
+func export(dir string) error {
+	b, err := request("GET", "/export", "", nil)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(strings.ToLower(dir), ".zip") {
+		return ioutil.WriteFile(dir, b, 0644)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		name := filepath.Join(dir, filepath.FromSlash(zf.Name))
+		if !strings.HasPrefix(name, filepath.Clean(dir)+string(filepath.Separator)) {
+			return fmt.Errorf("Unexpected file %q in export", zf.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err == nil {
+			err = ioutil.WriteFile(name, data, 0644)
+		}
+		if err != nil {
+			return err
+		}
+		os.Chtimes(name, zf.Modified, zf.Modified)
+	}
+	fmt.Printf("Exported %d posts to %s\n", len(zr.File), dir)
+	return nil
+}
+
+// pack zips the markdown files under dir
+func pack(dir string) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	err := filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && name != dir && strings.HasPrefix(fi.Name(), ".") {
+			return filepath.SkipDir
+		}
+		ext := strings.ToLower(filepath.Ext(name))
+		if fi.IsDir() || (ext != ".md" && ext != ".markdown") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		w, err := zw.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// upload imports the files in dir, or a zip of them, returning the server's
+// report
+func upload(dir string) (*report, error) {
+	var data []byte
+	var err error
+	if strings.HasSuffix(strings.ToLower(dir), ".zip") {
+		data, err = ioutil.ReadFile(dir)
+	} else {
+		data, err = pack(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if *dryRun {
+		mw.WriteField("dryrun", "1")
+	}
+	part, err := mw.CreateFormFile("file", "posts.zip")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(data); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	b, err := request("POST", "/import", mw.FormDataContentType(), &body)
+	if err != nil {
+		return nil, err
+	}
+	r := &report{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("Reading report: %v", err)
+	}
+	return r, nil
+}
+
+func print(r *report) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tTITLE\tRESULT")
+	for _, it := range r.Items {
+		title := it.Title
+		if it.Hidden {
+			title += " (draft)"
+		}
+		result := it.NewURL
+		switch {
+		case it.Skip != "":
+			result = "skip: " + it.Skip
+		case result == "":
+			result = "import as new post"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", it.File, title, result)
+	}
+	w.Flush()
+
+	verb := "Imported"
+	if r.DryRun {
+		verb = "Dry run: would import"
+	}
+	fmt.Printf("\n%s %d, skipped %d, %d conflicts\n", verb, r.Imported, r.Skipped, r.Conflicts)
+}
@@ -0,0 +1,145 @@
+// Command wxrimport imports a WordPress WXR export into a Dinghy blog, by
+// uploading it to the blog's "/import" endpoint. It needs an API token with
+// admin scope, which can be created on the blog's admin page.
+//
+//	wxrimport -site https://example.appspot.com -token dinghy_... [-n] export.xml
+//
+// With -n, nothing is imported, and the report shows what would be.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	site   = flag.String("site", "", "blog URL, e.g. https://example.appspot.com")
+	token  = flag.String("token", os.Getenv("DINGHY_TOKEN"), "API token with admin scope (default $DINGHY_TOKEN)")
+	dryRun = flag.Bool("n", false, "dry run: report what would be imported")
+)
+
+// The report returned by "/import"
+type report struct {
+	DryRun   bool
+	Imported int
+	Skipped  int
+	Items    []struct {
+		Title  string
+		Type   string
+		Date   time.Time
+		Hidden bool
+		Tags   []string
+		OldURL string
+		NewURL string
+		Skip   string
+	}
+}
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: wxrimport -site URL -token TOKEN [-n] export.xml\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *site == "" || *token == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	r, err := upload(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	print(r)
+}
+
+// upload posts the export, returning the server's report
+func upload(name string) (*report, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if *dryRun {
+		mw.WriteField("dryrun", "1")
+	}
+	part, err := mw.CreateFormFile("file", filepath.Base(name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, f); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(*site, "/")+"/import", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+*token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	r := &report{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("Reading report: %v", err)
+	}
+	return r, nil
+}
+
+func print(r *report) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DATE\tTITLE\tOLD URL\tRESULT")
+	for _, it := range r.Items {
+		title := it.Title
+		if it.Hidden {
+			title += " (draft)"
+		}
+		result := it.NewURL
+		switch {
+		case it.Skip != "":
+			result = "skip: " + it.Skip
+		case result == "":
+			result = "import"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", it.Date.Format("2006-01-02"), title, it.OldURL, result)
+	}
+	w.Flush()
+
+	if r.DryRun {
+		fmt.Printf("\nDry run: would import %d, skipping %d\n", r.Imported, r.Skipped)
+	} else {
+		fmt.Printf("\nImported %d, skipped %d\n", r.Imported, r.Skipped)
+	}
+}
@@ -0,0 +1,723 @@
+package dinghy
+
+/**
+ *  A versioned JSON API for posts and blog settings, served under /api/v1.
+ *
+ *    GET    /api/v1/posts          list posts, newest first (?limit=&offset=)
+ *    POST   /api/v1/posts          create a post
+ *    GET    /api/v1/posts/{id}     fetch a post
+ *    PUT    /api/v1/posts/{id}     replace a post
+ *    PATCH  /api/v1/posts/{id}     update some fields (JSON merge patch)
+ *    DELETE /api/v1/posts/{id}     delete a post
+ *    GET    /api/v1/blog           fetch blog settings
+ *    PUT    /api/v1/blog           replace blog settings
+ *    PATCH  /api/v1/blog           update some settings
+ *    GET    /api/v1/openapi.json   this API, described from the Go types below
+ *
+ *  Every response carries an ETag. Updates and deletes must send it back in
+ *  If-Match, and fail with 412 if the resource changed in the meantime.
+ *  Errors are returned as an APIError object.
+ */
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// APIPost is the API representation of a Post. Content holds the full post
+// markdown; the lead is split off when saving, as with the admin editor.
+type APIPost struct {
+	ID           int64
+	Title        string
+	Description  string
+	Content      string `json:",omitempty"`
+	Date         time.Time
+	Hidden       bool
+	Tags         []string
+	CommentCount int
+	URL          string
+	// Set from whoever creates the post
+	AuthorID string `json:",omitempty"`
+}
+
+// APIBlog is the API representation of the Blog settings
+type APIBlog struct {
+	Title        string
+	Description  string
+	Author       string
+	Template     string
+	Embeds       []EmbedProvider
+	Hubs         []string
+	BaseURL      string
+	CacheControl []CacheRule
+}
+
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// Fields of APIPost and APIBlog that clients can't change
+var readOnlyFields = map[string]bool{"ID": true, "CommentCount": true, "URL": true}
+
+var errNotFound = &APIError{http.StatusNotFound, "not_found", "No such resource"}
+
+func apiError(status int, code, msg string) *APIError {
+	return &APIError{Status: status, Code: code, Message: msg}
+}
+
+// api dispatches requests under /api/v1/
+func api(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1"), "/")
+	parts := strings.Split(path, "/")
+
+	var err error
+	switch {
+	case path == "openapi.json":
+		err = apiSpec(w, r)
+	case path == "blog":
+		err = apiBlog(w, r, c)
+	case path == "posts":
+		err = apiPosts(w, r, c)
+	case len(parts) == 2 && parts[0] == "posts":
+		id, perr := strconv.ParseInt(parts[1], 10, 64)
+		if perr != nil {
+			err = errNotFound
+		} else {
+			err = apiPostByID(w, r, id, c)
+		}
+	default:
+		err = errNotFound
+	}
+
+	if err != nil {
+		writeAPIError(w, err)
+	}
+}
+
+// requirePermission returns the caller, if their role has the given
+// permission
+func requirePermission(c appengine.Context, r *http.Request, perm permission) (caller, error) {
+	cl := requestCaller(c, r)
+	if cl.can(perm) {
+		return cl, nil
+	}
+	if !cl.Authenticated {
+		return cl, apiError(http.StatusUnauthorized, "unauthorized", "Authentication required")
+	}
+	return cl, apiError(http.StatusForbidden, "forbidden", cl.refusal(perm))
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	e, ok := err.(*APIError)
+	if !ok {
+		e = apiError(http.StatusInternalServerError, "internal", err.Error())
+	}
+	writeJSON(w, e.Status, e, "")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}, etag string) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.WriteHeader(status)
+	w.Write(j)
+}
+
+// etagOf returns a strong validator for the JSON form of v
+func etagOf(v interface{}) string {
+	j, _ := json.Marshal(v)
+	return contentETag(j)
+}
+
+// checkIfMatch enforces optimistic concurrency on updates. The client must
+// send the ETag of the version it is modifying.
+func checkIfMatch(r *http.Request, etag string) error {
+	m := r.Header.Get("If-Match")
+	switch {
+	case m == "":
+		return apiError(http.StatusPreconditionRequired, "precondition_required", "Updates require an If-Match header")
+	case m == "*":
+		return nil
+	}
+	for _, t := range strings.Split(m, ",") {
+		if strings.TrimSpace(t) == etag {
+			return nil
+		}
+	}
+	return apiError(http.StatusPreconditionFailed, "precondition_failed", "The resource has changed")
+}
+
+// notModified handles If-None-Match on GET requests
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	if m := r.Header.Get("If-None-Match"); m != "" {
+		for _, t := range strings.Split(m, ",") {
+			if t = strings.TrimSpace(t); t == etag || t == "*" {
+				w.Header().Set("ETag", etag)
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readBody returns the JSON request body. It is read once up front, since
+// transactions may run the update more than once.
+func readBody(r *http.Request) ([]byte, error) {
+	ct := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(ct, "application/json") && !strings.HasPrefix(ct, "application/merge-patch+json") {
+		return nil, apiError(http.StatusUnsupportedMediaType, "unsupported_media_type", "Request bodies must be JSON")
+	}
+	return ioutil.ReadAll(io.LimitReader(r.Body, 4<<20))
+}
+
+// decodeBody reads a JSON request body into v. With patch set, v must already
+// hold the current resource, and the body is applied to it as a JSON merge
+// patch (RFC 7386).
+func decodeBody(body []byte, v interface{}, patch bool) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return apiError(http.StatusBadRequest, "bad_request", err.Error())
+	}
+	for f := range fields {
+		if readOnlyFields[f] {
+			delete(fields, f)
+		}
+	}
+
+	if patch {
+		current, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		merged := make(map[string]json.RawMessage)
+		json.Unmarshal(current, &merged)
+		for f, val := range fields {
+			if string(val) == "null" {
+				delete(merged, f)
+			} else {
+				merged[f] = val
+			}
+		}
+		fields = merged
+
+		// A null removes a member, so its field is reset rather than kept
+		rv := reflect.ValueOf(v).Elem()
+		rv.Set(reflect.Zero(rv.Type()))
+	}
+
+	j, _ := json.Marshal(fields)
+	if err := json.Unmarshal(j, v); err != nil {
+		return apiError(http.StatusBadRequest, "bad_request", err.Error())
+	}
+	return nil
+}
+
+func toAPIPost(p *Post, id int64) APIPost {
+	return APIPost{
+		ID:           id,
+		Title:        p.Title,
+		Description:  p.Description,
+		Content:      p.Lead + p.Content,
+		Date:         p.Date,
+		Hidden:       p.Hidden,
+		Tags:         p.Tags,
+		CommentCount: p.CommentCount,
+		URL:          "/" + strconv.FormatInt(id, 10),
+		AuthorID:     p.AuthorID,
+	}
+}
+
+// fromAPIPost copies the writable fields of a into p
+func fromAPIPost(a *APIPost, p *Post) error {
+	if strings.TrimSpace(a.Title) == "" {
+		return apiError(http.StatusUnprocessableEntity, "invalid", "Title is required")
+	}
+	p.Title = a.Title
+	p.Description = a.Description
+	p.Lead, p.Content = splitLead(a.Content)
+	p.Hidden = a.Hidden
+	p.Tags = cleanTags(a.Tags)
+	p.Date = a.Date
+	if p.Date.IsZero() {
+		p.Date = time.Now()
+	}
+	return nil
+}
+
+func apiPosts(w http.ResponseWriter, r *http.Request, c appengine.Context) error {
+	switch r.Method {
+	case "GET":
+		limit, _ := strconv.Atoi(r.FormValue("limit"))
+		if limit <= 0 || limit > 100 {
+			limit = 20
+		}
+		offset, _ := strconv.Atoi(r.FormValue("offset"))
+
+		q := datastore.NewQuery("Post").Order("-Date").Offset(offset).Limit(limit)
+		if !isAdmin(c, r) {
+			q = q.Filter("Hidden =", false)
+		}
+
+		var p []Post
+		keys, err := q.GetAll(c, &p)
+		if err != nil {
+			return err
+		}
+
+		a := make([]APIPost, len(p))
+		for i := range p {
+			a[i] = toAPIPost(&p[i], keys[i].IntID())
+			a[i].Content = ""
+		}
+
+		etag := etagOf(a)
+		if !notModified(w, r, etag) {
+			writeJSON(w, http.StatusOK, a, etag)
+		}
+		return nil
+
+	case "POST":
+		cl, err := requirePermission(c, r, permDraft)
+		if err != nil {
+			return err
+		}
+
+		body, err := readBody(r)
+		if err != nil {
+			return err
+		}
+		a := APIPost{}
+		if err := decodeBody(body, &a, false); err != nil {
+			return err
+		}
+		p := Post{AuthorID: cl.AuthorID}
+		if err := fromAPIPost(&a, &p); err != nil {
+			return err
+		}
+		if err := cl.canSave(nil, &p); err != nil {
+			return apiError(http.StatusForbidden, "forbidden", err.Error())
+		}
+
+		k, err := savePost(c, datastore.NewIncompleteKey(c, "Post", nil), &p)
+		if err != nil {
+			return err
+		}
+
+		a = toAPIPost(&p, k.IntID())
+		w.Header().Set("Location", "/api/v1/posts/"+strconv.FormatInt(a.ID, 10))
+		writeJSON(w, http.StatusCreated, a, etagOf(a))
+		return nil
+	}
+
+	w.Header().Set("Allow", "GET, POST")
+	return apiError(http.StatusMethodNotAllowed, "method_not_allowed", r.Method+" is not supported")
+}
+
+func apiPostByID(w http.ResponseWriter, r *http.Request, id int64, c appengine.Context) error {
+	k := datastore.NewKey(c, "Post", "", id, nil)
+
+	if r.Method == "GET" {
+		p := Post{}
+		if err := datastore.Get(c, k, &p); err == datastore.ErrNoSuchEntity {
+			return errNotFound
+		} else if err != nil {
+			return err
+		}
+		if p.Hidden && !isAdmin(c, r) {
+			return errNotFound
+		}
+
+		a := toAPIPost(&p, id)
+		etag := etagOf(a)
+		if !notModified(w, r, etag) {
+			writeJSON(w, http.StatusOK, a, etag)
+		}
+		return nil
+	}
+
+	if r.Method != "PUT" && r.Method != "PATCH" && r.Method != "DELETE" {
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
+		return apiError(http.StatusMethodNotAllowed, "method_not_allowed", r.Method+" is not supported")
+	}
+
+	cl, err := requirePermission(c, r, permDraft)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	if r.Method != "DELETE" {
+		if body, err = readBody(r); err != nil {
+			return err
+		}
+	}
+
+	// Compare and update in a transaction, so concurrent writers can't both
+	// match the same ETag
+	var a APIPost
+	var oldDate time.Time
+	p := Post{}
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		if err := datastore.Get(tc, k, &p); err == datastore.ErrNoSuchEntity {
+			return errNotFound
+		} else if err != nil {
+			return err
+		}
+		oldDate = p.Date
+
+		a = toAPIPost(&p, id)
+		if err := checkIfMatch(r, etagOf(a)); err != nil {
+			return err
+		}
+
+		if r.Method == "DELETE" {
+			if err := cl.canDelete(&p); err != nil {
+				return apiError(http.StatusForbidden, "forbidden", err.Error())
+			}
+			return nil
+		}
+
+		old := p
+		if r.Method == "PUT" {
+			a = APIPost{}
+		}
+		if err := decodeBody(body, &a, r.Method == "PATCH"); err != nil {
+			return err
+		}
+		if err := fromAPIPost(&a, &p); err != nil {
+			return err
+		}
+		if err := cl.canSave(&old, &p); err != nil {
+			return apiError(http.StatusForbidden, "forbidden", err.Error())
+		}
+
+		p.Updated = time.Now()
+		_, err := datastore.Put(tc, k, &p)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == "DELETE" {
+		if err := memcache.Flush(c); err != nil {
+			return err
+		}
+		if err := removePost(c, id); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	// As savePost does, outside the transaction
+	if err := memcache.Flush(c); err != nil {
+		return err
+	}
+	if !oldDate.Equal(p.Date) {
+		expireArchive(c, oldDate)
+	}
+	if err := postSaved(c, id, &p); err != nil {
+		return err
+	}
+
+	a = toAPIPost(&p, id)
+	writeJSON(w, http.StatusOK, a, etagOf(a))
+	return nil
+}
+
+func apiBlog(w http.ResponseWriter, r *http.Request, c appengine.Context) error {
+	k := datastore.NewKey(c, "Blog", "singleton", 0, nil)
+
+	switch r.Method {
+	case "GET":
+		b := Blog{}
+		if err := datastore.Get(c, k, &b); err == datastore.ErrNoSuchEntity {
+			return errNotFound
+		} else if err != nil {
+			return err
+		}
+
+		a := APIBlog{b.Title, b.Description, b.Author, b.Template, b.Embeds, b.Hubs, b.BaseURL, b.CacheControl}
+		etag := etagOf(a)
+		if !notModified(w, r, etag) {
+			writeJSON(w, http.StatusOK, a, etag)
+		}
+		return nil
+
+	case "PUT", "PATCH":
+		if _, err := requirePermission(c, r, permManage); err != nil {
+			return err
+		}
+		body, err := readBody(r)
+		if err != nil {
+			return err
+		}
+
+		var a APIBlog
+		err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+			b := Blog{}
+			if err := datastore.Get(tc, k, &b); err == datastore.ErrNoSuchEntity {
+				return errNotFound
+			} else if err != nil {
+				return err
+			}
+
+			a = APIBlog{b.Title, b.Description, b.Author, b.Template, b.Embeds, b.Hubs, b.BaseURL, b.CacheControl}
+			if err := checkIfMatch(r, etagOf(a)); err != nil {
+				return err
+			}
+
+			if r.Method == "PUT" {
+				a = APIBlog{}
+			}
+			if err := decodeBody(body, &a, r.Method == "PATCH"); err != nil {
+				return err
+			}
+			if a.Template == "" {
+				a.Template = defaultViewTemplateHTML
+			}
+			if err := validateBlog(&a, tc); err != nil {
+				return err
+			}
+
+			b.Title, b.Description, b.Author, b.Template, b.Embeds, b.Hubs, b.BaseURL, b.CacheControl =
+				a.Title, a.Description, a.Author, a.Template, a.Embeds, a.Hubs, a.BaseURL, a.CacheControl
+			_, err := datastore.Put(tc, k, &b)
+			return err
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		if err := memcache.Flush(c); err != nil {
+			return err
+		}
+		expireFeed(c)
+		expireArchives(c)
+		writeJSON(w, http.StatusOK, a, etagOf(a))
+		return nil
+	}
+
+	w.Header().Set("Allow", "GET, PUT, PATCH")
+	return apiError(http.StatusMethodNotAllowed, "method_not_allowed", r.Method+" is not supported")
+}
+
+// validateBlog checks settings the same way the admin page does before saving
+func validateBlog(a *APIBlog, c appengine.Context) error {
+	if strings.TrimSpace(a.Title) == "" {
+		return apiError(http.StatusUnprocessableEntity, "invalid", "Title is required")
+	}
+	if _, err := template.New("config").Funcs(funcMap(false, nil, c)).Parse(a.Template); err != nil {
+		return apiError(http.StatusUnprocessableEntity, "invalid", err.Error())
+	}
+	if _, err := compileEmbeds(a.Embeds); err != nil {
+		return apiError(http.StatusUnprocessableEntity, "invalid", err.Error())
+	}
+	if err := validateHubs(a.Hubs); err != nil {
+		return apiError(http.StatusUnprocessableEntity, "invalid", err.Error())
+	}
+	base, err := parseBaseURL(a.BaseURL)
+	if err != nil {
+		return apiError(http.StatusUnprocessableEntity, "invalid", err.Error())
+	}
+	a.BaseURL = base
+	if err := validateCacheRules(a.CacheControl); err != nil {
+		return apiError(http.StatusUnprocessableEntity, "invalid", err.Error())
+	}
+	return nil
+}
+
+// apiSpec serves an OpenAPI 3 description of the API. Schemas are generated
+// from the Go types, so they can't drift from what the handlers accept.
+func apiSpec(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return apiError(http.StatusMethodNotAllowed, "method_not_allowed", r.Method+" is not supported")
+	}
+
+	ref := func(name string) map[string]interface{} {
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	body := func(schema map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schema},
+			},
+		}
+	}
+	reply := func(desc string, schema map[string]interface{}) map[string]interface{} {
+		rep := map[string]interface{}{"description": desc}
+		if schema != nil {
+			rep["content"] = body(schema)["content"]
+		}
+		return rep
+	}
+	// Every operation may also fail with an APIError
+	with := func(m map[string]interface{}) map[string]interface{} {
+		m["default"] = reply("Error", ref("APIError"))
+		return m
+	}
+	ifMatch := []interface{}{map[string]interface{}{
+		"name": "If-Match", "in": "header", "required": true,
+		"schema": map[string]interface{}{"type": "string"},
+	}}
+	idParam := map[string]interface{}{
+		"name": "id", "in": "path", "required": true,
+		"schema": map[string]interface{}{"type": "integer", "format": "int64"},
+	}
+
+	spec := map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "Dinghy API",
+			"version": "1",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": "/api/v1"}},
+		"paths": map[string]interface{}{
+			"/posts": map[string]interface{}{
+				"get": map[string]interface{}{
+					"summary": "List posts, newest first",
+					"parameters": []interface{}{
+						map[string]interface{}{"name": "limit", "in": "query", "schema": map[string]interface{}{"type": "integer"}},
+						map[string]interface{}{"name": "offset", "in": "query", "schema": map[string]interface{}{"type": "integer"}},
+					},
+					"responses": with(map[string]interface{}{
+						"200": reply("Posts, without content", map[string]interface{}{"type": "array", "items": ref("APIPost")}),
+					}),
+				},
+				"post": map[string]interface{}{
+					"summary":     "Create a post",
+					"requestBody": body(ref("APIPost")),
+					"responses":   with(map[string]interface{}{"201": reply("Created", ref("APIPost"))}),
+				},
+			},
+			"/posts/{id}": map[string]interface{}{
+				"parameters": []interface{}{idParam},
+				"get": map[string]interface{}{
+					"summary":   "Fetch a post",
+					"responses": with(map[string]interface{}{"200": reply("The post", ref("APIPost"))}),
+				},
+				"put": map[string]interface{}{
+					"summary":     "Replace a post",
+					"parameters":  ifMatch,
+					"requestBody": body(ref("APIPost")),
+					"responses":   with(map[string]interface{}{"200": reply("The updated post", ref("APIPost"))}),
+				},
+				"patch": map[string]interface{}{
+					"summary":     "Update a post with a JSON merge patch",
+					"parameters":  ifMatch,
+					"requestBody": body(ref("APIPost")),
+					"responses":   with(map[string]interface{}{"200": reply("The updated post", ref("APIPost"))}),
+				},
+				"delete": map[string]interface{}{
+					"summary":    "Delete a post",
+					"parameters": ifMatch,
+					"responses":  with(map[string]interface{}{"204": reply("Deleted", nil)}),
+				},
+			},
+			"/blog": map[string]interface{}{
+				"get": map[string]interface{}{
+					"summary":   "Fetch blog settings",
+					"responses": with(map[string]interface{}{"200": reply("The settings", ref("APIBlog"))}),
+				},
+				"put": map[string]interface{}{
+					"summary":     "Replace blog settings",
+					"parameters":  ifMatch,
+					"requestBody": body(ref("APIBlog")),
+					"responses":   with(map[string]interface{}{"200": reply("The updated settings", ref("APIBlog"))}),
+				},
+				"patch": map[string]interface{}{
+					"summary":     "Update blog settings with a JSON merge patch",
+					"parameters":  ifMatch,
+					"requestBody": body(ref("APIBlog")),
+					"responses":   with(map[string]interface{}{"200": reply("The updated settings", ref("APIBlog"))}),
+				},
+			},
+		},
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"APIPost":       schemaOf(reflect.TypeOf(APIPost{})),
+				"APIBlog":       schemaOf(reflect.TypeOf(APIBlog{})),
+				"APIError":      schemaOf(reflect.TypeOf(APIError{})),
+				"EmbedProvider": schemaOf(reflect.TypeOf(EmbedProvider{})),
+				"CacheRule":     schemaOf(reflect.TypeOf(CacheRule{})),
+			},
+		},
+	}
+
+	writeJSON(w, http.StatusOK, spec, "")
+	return nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf describes a Go type as an OpenAPI schema. Named structs other than
+// the top level type are referenced by name, and listed in components.
+func schemaOf(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		s := map[string]interface{}{"type": "integer"}
+		if t.Kind() == reflect.Int64 {
+			s["format"] = "int64"
+		}
+		return s
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case t.Kind() == reflect.Slice:
+		item := schemaOf(t.Elem())
+		if t.Elem().Kind() == reflect.Struct && t.Elem() != timeType {
+			item = map[string]interface{}{"$ref": "#/components/schemas/" + t.Elem().Name()}
+		}
+		return map[string]interface{}{"type": "array", "items": item}
+	case t.Kind() == reflect.Struct:
+		props := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "-" || f.PkgPath != "" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			s := schemaOf(f.Type)
+			if readOnlyFields[f.Name] {
+				s["readOnly"] = true
+			}
+			props[name] = s
+		}
+		return map[string]interface{}{"type": "object", "properties": props}
+	}
+	panic(errors.New("schemaOf: unsupported type " + t.String()))
+}
@@ -0,0 +1,57 @@
+package dinghy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// refs collects the schema names referenced anywhere in a JSON document
+func refs(v interface{}, found map[string]bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if s, ok := e.(string); ok && k == "$ref" {
+				found[strings.TrimPrefix(s, "#/components/schemas/")] = true
+			}
+			refs(e, found)
+		}
+	case []interface{}:
+		for _, e := range v {
+			refs(e, found)
+		}
+	}
+}
+
+func TestAPISpecRefs(t *testing.T) {
+	w := httptest.NewRecorder()
+	if err := apiSpec(w, httptest.NewRequest("GET", "/api/v1/openapi.json", nil)); err != nil {
+		t.Fatalf("apiSpec: %v", err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("apiSpec status %d, want 200", w.Code)
+	}
+
+	var spec struct {
+		Paths      map[string]interface{}
+		Components struct {
+			Schemas map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("Spec is not JSON: %v", err)
+	}
+
+	found := make(map[string]bool)
+	refs(spec.Paths, found)
+	for _, s := range spec.Components.Schemas {
+		refs(s, found)
+	}
+	for name := range found {
+		if _, ok := spec.Components.Schemas[name]; !ok {
+			t.Errorf("Schema %q is referenced but not defined", name)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Year and month buckets returned by the "archives" template function
+type ArchiveYear struct {
+	Year   int
+	Count  int
+	Path   string
+	Months []ArchiveMonth
+}
+
+type ArchiveMonth struct {
+	Year  int
+	Month time.Month
+	Count int
+	Path  string
+}
+
+var archivePathRe = regexp.MustCompile(`^(\d{4})(?:/(\d{2}))?$`)
+
+// archivePeriod parses an archive path, "YYYY" or "YYYY/MM", returning the
+// date range it covers and a label for display. The range is in UTC, which is
+// also how post dates are stored.
+func archivePeriod(path string) (start, end time.Time, label string, ok bool) {
+	m := archivePathRe.FindStringSubmatch(path)
+	if m == nil {
+		return
+	}
+
+	year, _ := strconv.Atoi(m[1])
+	if m[2] == "" {
+		start = time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(1, 0, 0), m[1], true
+	}
+
+	month, _ := strconv.Atoi(m[2])
+	if month < 1 || month > 12 {
+		return
+	}
+	start = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0), start.Format("January 2006"), true
+}
+
+// getArchivePosts returns posts dated within [start, end), newest first
+func getArchivePosts(start, end time.Time, admin bool, c appengine.Context) ([]Post, error) {
+	p := make([]Post, 0)
+	q := datastore.NewQuery("Post").
+		Filter("Date >=", start).
+		Filter("Date <", end).
+		Order("-Date").
+		Project("Title", "Lead", "Date")
+
+	if !admin {
+		q = q.Filter("Hidden =", false)
+	}
+
+	keys, err := q.GetAll(c, &p)
+	if err != nil {
+		return p, err
+	}
+
+	for i := 0; i < len(p); i++ {
+		p[i].ID = keys[i].IntID()
+	}
+	return p, nil
+}
+
+// tagPrefix starts the paths of tag pages, "tag/NAME", listing the posts with
+// that tag
+const tagPrefix = "tag/"
+
+// tagPath returns the address of a tag's page
+func tagPath(tag string) string {
+	return "/" + tagPrefix + url.PathEscape(tag)
+}
+
+// getTagPosts returns the posts with a tag, newest first
+func getTagPosts(tag string, admin bool, c appengine.Context) ([]Post, error) {
+	return getPostsWhere("Tags =", tag, admin, c)
+}
+
+// getAuthorPosts returns an author's posts, newest first
+func getAuthorPosts(id string, admin bool, c appengine.Context) ([]Post, error) {
+	return getPostsWhere("AuthorID =", id, admin, c)
+}
+
+// getPostsWhere lists the posts matching a filter, as the archive does
+func getPostsWhere(filter, value string, admin bool, c appengine.Context) ([]Post, error) {
+	p := make([]Post, 0)
+	q := datastore.NewQuery("Post").
+		Filter(filter, value).
+		Order("-Date").
+		Project("Title", "Lead", "Date")
+
+	if !admin {
+		q = q.Filter("Hidden =", false)
+	}
+
+	keys, err := q.GetAll(c, &p)
+	if err != nil {
+		return p, err
+	}
+
+	for i := 0; i < len(p); i++ {
+		p[i].ID = keys[i].IntID()
+	}
+	return p, nil
+}
+
+// archives counts posts by year and month, newest first. It reads only post
+// dates, and the result is cached until the next post is saved, which flushes
+// memcache. Admins see hidden posts counted, so their results aren't cached.
+func archives(admin bool, c appengine.Context) ([]ArchiveYear, error) {
+	y := make([]ArchiveYear, 0)
+
+	if !admin {
+		if _, err := memcache.Gob.Get(c, "archives", &y); err == nil {
+			return y, nil
+		}
+	}
+
+	p := make([]Post, 0)
+	q := datastore.NewQuery("Post").Order("-Date").Project("Date")
+	if !admin {
+		q = q.Filter("Hidden =", false)
+	}
+	if _, err := q.GetAll(c, &p); err != nil {
+		return y, err
+	}
+
+	for _, post := range p {
+		d := post.Date.UTC()
+		if len(y) == 0 || y[len(y)-1].Year != d.Year() {
+			y = append(y, ArchiveYear{
+				Year: d.Year(),
+				Path: fmt.Sprintf("/%04d", d.Year()),
+			})
+		}
+		year := &y[len(y)-1]
+		year.Count++
+
+		if len(year.Months) == 0 || year.Months[len(year.Months)-1].Month != d.Month() {
+			year.Months = append(year.Months, ArchiveMonth{
+				Year:  d.Year(),
+				Month: d.Month(),
+				Path:  fmt.Sprintf("/%04d/%02d", d.Year(), d.Month()),
+			})
+		}
+		year.Months[len(year.Months)-1].Count++
+	}
+
+	if !admin {
+		memcache.Gob.Set(c, &memcache.Item{
+			Key:    "archives",
+			Object: y,
+		})
+	}
+	return y, nil
+}
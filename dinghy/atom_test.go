@@ -0,0 +1,232 @@
+package dinghy
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The parts of an Atom document that RFC 4287 requires, read back from
+// renderAtom's output
+type atomDoc struct {
+	XMLName xml.Name
+	ID      string       `xml:"id"`
+	Title   string       `xml:"title"`
+	Updated string       `xml:"updated"`
+	Author  *atomPerson  `xml:"author"`
+	Links   []atomLink   `xml:"link"`
+	Entries []atomRecord `xml:"entry"`
+}
+
+type atomRecord struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published"`
+	Author    *atomPerson `xml:"author"`
+	Links     []atomLink  `xml:"link"`
+	Content   struct {
+		Type string `xml:"type,attr"`
+		Body string `xml:",chardata"`
+	} `xml:"content"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+const atomNS = "http://www.w3.org/2005/Atom"
+
+// testFeed returns a subscription document's feedData, as buildFeed would
+// for a blog at base with n posts
+func testFeed(base string, n int) feedData {
+	now := time.Date(2014, 3, 1, 12, 0, 0, 0, time.UTC)
+	f := feedData{
+		Title:   "A Blog",
+		Author:  "A Blogger",
+		ID:      feedID("blog.example"),
+		Home:    base + "/",
+		Base:    base,
+		Updated: now,
+		Items:   make([]feedItem, 0),
+		Doc:     feedDoc{Page: 1},
+		Pages:   1,
+	}
+	for i := 1; i <= n; i++ {
+		date := now.AddDate(0, 0, -i)
+		f.Items = append(f.Items, feedItem{
+			ID:        fmt.Sprintf("%s.post-%d", f.ID, i),
+			URL:       fmt.Sprintf("%s/%d", base, i),
+			Title:     fmt.Sprintf("Post %d", i),
+			HTML:      "<p>Post & more</p>",
+			Tags:      []string{"go"},
+			Published: date,
+			Updated:   date,
+			Author:    f.Author,
+		})
+	}
+	if n > 0 {
+		f.Updated = f.Items[0].Updated
+	}
+	return f
+}
+
+func parseAtom(t *testing.T, f feedData) atomDoc {
+	out, err := renderAtom(&f, atomFeed.url(f.Base))
+	if err != nil {
+		t.Fatalf("renderAtom: %v", err)
+	}
+	var doc atomDoc
+	if err := xml.Unmarshal(out, &doc); err != nil {
+		t.Fatalf("Feed is not well-formed XML: %v\n%s", err, out)
+	}
+	return doc
+}
+
+// checkDate checks an Atom date construct is an RFC 3339 timestamp
+func checkDate(t *testing.T, what, s string) {
+	if _, err := time.Parse(time.RFC3339, s); err != nil {
+		t.Errorf("%s %q is not an RFC 3339 date: %v", what, s, err)
+	}
+}
+
+func hasLink(links []atomLink, rel, href string) bool {
+	for _, l := range links {
+		if l.Rel == rel && l.Href == href {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRequired checks the elements RFC 4287 section 4.1 requires of feeds
+// and entries
+func checkRequired(t *testing.T, doc atomDoc) {
+	if doc.XMLName.Space != atomNS || doc.XMLName.Local != "feed" {
+		t.Errorf("Root element is {%s}%s, want {%s}feed", doc.XMLName.Space, doc.XMLName.Local, atomNS)
+	}
+	if doc.ID == "" || doc.Title == "" {
+		t.Errorf("Feed id %q and title %q must not be empty", doc.ID, doc.Title)
+	}
+	checkDate(t, "Feed updated", doc.Updated)
+	if doc.Author == nil || doc.Author.Name == "" {
+		t.Error("Feed has no author name")
+	}
+
+	ids := make(map[string]bool)
+	for i, e := range doc.Entries {
+		if e.ID == "" || e.Title == "" {
+			t.Errorf("Entry %d id %q and title %q must not be empty", i, e.ID, e.Title)
+		}
+		if ids[e.ID] {
+			t.Errorf("Entry %d repeats id %q", i, e.ID)
+		}
+		ids[e.ID] = true
+		checkDate(t, "Entry updated", e.Updated)
+		checkDate(t, "Entry published", e.Published)
+		if e.Author == nil || e.Author.Name == "" {
+			t.Errorf("Entry %d has no author name", i)
+		}
+		if len(e.Links) == 0 || e.Links[0].Rel != "alternate" {
+			t.Errorf("Entry %d has no alternate link", i)
+		}
+		if e.Content.Type != "html" || !strings.Contains(e.Content.Body, "<p>Post & more</p>") {
+			t.Errorf("Entry %d content is %q of type %q, want the post's HTML", i, e.Content.Body, e.Content.Type)
+		}
+	}
+}
+
+func TestRenderAtom(t *testing.T) {
+	f := testFeed("https://blog.example", 3)
+	doc := parseAtom(t, f)
+	checkRequired(t, doc)
+
+	if len(doc.Entries) != 3 {
+		t.Fatalf("Feed has %d entries, want 3", len(doc.Entries))
+	}
+	if doc.ID != f.ID || doc.Entries[0].ID != f.Items[0].ID {
+		t.Errorf("Feed id %q and first entry id %q, want %q and %q", doc.ID, doc.Entries[0].ID, f.ID, f.Items[0].ID)
+	}
+	if doc.Updated != "2014-02-28T12:00:00Z" {
+		t.Errorf("Feed updated %q, want the newest entry's date", doc.Updated)
+	}
+	if !hasLink(doc.Links, "self", "https://blog.example/atom.xml") {
+		t.Errorf("Feed links %v, want a self link to the feed", doc.Links)
+	}
+}
+
+func TestRenderAtomEmptyBlog(t *testing.T) {
+	f := testFeed("https://blog.example", 0)
+	f.Author = f.Title
+	doc := parseAtom(t, f)
+	checkRequired(t, doc)
+
+	if len(doc.Entries) != 0 {
+		t.Errorf("Empty blog's feed has %d entries", len(doc.Entries))
+	}
+	if doc.Updated != atomTime(f.Updated) {
+		t.Errorf("Empty blog's feed updated %q, want %q", doc.Updated, atomTime(f.Updated))
+	}
+}
+
+func TestRenderAtomBaseURL(t *testing.T) {
+	for _, base := range []string{"https://blog.example", "http://example.com/blog"} {
+		doc := parseAtom(t, testFeed(base, 2))
+
+		if !hasLink(doc.Links, "alternate", base+"/") {
+			t.Errorf("%s: feed links %v, want an alternate link to the home page", base, doc.Links)
+		}
+		links := doc.Links
+		for _, e := range doc.Entries {
+			links = append(links, e.Links...)
+		}
+		for _, l := range links {
+			if !strings.HasPrefix(l.Href, base+"/") {
+				t.Errorf("%s: %s link %q is not on the blog", base, l.Rel, l.Href)
+			}
+		}
+	}
+}
+
+func TestSiteURL(t *testing.T) {
+	b := Blog{BaseURL: "https://blog.example"}
+	if got := siteURL(b, nil); got != b.BaseURL {
+		t.Errorf("siteURL = %q, want the BaseURL %q", got, b.BaseURL)
+	}
+
+	for in, want := range map[string]string{
+		"":                          "",
+		" https://blog.example/ ":   "https://blog.example",
+		"http://example.com/blog/":  "http://example.com/blog",
+		"ftp://blog.example":        "error",
+		"https://blog.example/?p=1": "error",
+	} {
+		got, err := parseBaseURL(in)
+		if err != nil {
+			got = "error"
+		}
+		if got != want {
+			t.Errorf("parseBaseURL(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestAtomTime(t *testing.T) {
+	zone := time.FixedZone("AEST", 10*60*60)
+	tests := map[time.Time]string{
+		time.Date(2014, 3, 1, 9, 30, 0, 0, zone):        "2014-02-28T23:30:00Z",
+		time.Date(2014, 3, 1, 9, 30, 15, 500, time.UTC): "2014-03-01T09:30:15Z",
+	}
+	for in, want := range tests {
+		if got := atomTime(in); got != want {
+			t.Errorf("atomTime(%v) = %q, want %q", in, got, want)
+		}
+	}
+}
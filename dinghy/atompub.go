@@ -0,0 +1,541 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ *  Atom Publishing Protocol (RFC 5023) support, built on the Atom types used
+ *  for the feed. The service document at "/atompub" lists two collections:
+ *
+ *    /atompub/posts        posts, as atom:entry documents
+ *    /atompub/media        uploaded files, as media link entries
+ *
+ *  Members are at "/atompub/posts/{id}" and "/atompub/media/{id}". Clients
+ *  authenticate with an API token, as the HTTP basic authentication password
+ *  or as a bearer token, so the API is only served over HTTPS. Post content is
+ *  exchanged as markdown, in text content; html content is stored as is, since
+ *  markdown passes HTML through.
+ */
+
+const (
+	atomNamespace  = "http://www.w3.org/2005/Atom"
+	atomEntryType  = "application/atom+xml;type=entry"
+	atomFeedType   = "application/atom+xml;type=feed"
+	atompubPerPage = 20
+)
+
+type Service struct {
+	XMLName   xml.Name  `xml:"http://www.w3.org/2007/app service"`
+	Workspace Workspace `xml:"workspace"`
+}
+
+type Workspace struct {
+	Title       string       `xml:"http://www.w3.org/2005/Atom title"`
+	Collections []Collection `xml:"collection"`
+}
+
+type Collection struct {
+	Href       string   `xml:"href,attr"`
+	Title      string   `xml:"http://www.w3.org/2005/Atom title"`
+	Accept     []string `xml:"accept"`
+	Categories *Categories
+}
+
+// Posts take free form tags as categories
+type Categories struct {
+	XMLName xml.Name `xml:"categories"`
+	Fixed   string   `xml:"fixed,attr"`
+}
+
+// atompub dispatches requests under "/atompub"
+func atompub(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/atompub"), "/"), "/")
+
+	// Saving and deleting posts are checked against each post
+	perm := permDraft
+	if r.Method == "GET" || r.Method == "HEAD" {
+		perm = permRead
+	} else if parts[0] == "media" {
+		perm = permUpload
+	}
+	cl := requestCaller(c, r)
+	if !cl.can(perm) {
+		if !cl.Authenticated {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dinghy"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+		} else {
+			http.Error(w, cl.refusal(perm), http.StatusForbidden)
+		}
+		return
+	}
+
+	// Links are to the blog's configured address, which is https by default
+	base, err := blogURL(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var id int64
+	if len(parts) == 2 {
+		var err error
+		if id, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	switch {
+	case parts[0] == "" && len(parts) == 1:
+		atompubService(w, r, base, c)
+	case parts[0] == "posts" && len(parts) == 1:
+		atompubPosts(w, r, base, cl, c)
+	case parts[0] == "posts" && len(parts) == 2:
+		atompubPost(w, r, base, id, cl, c)
+	case parts[0] == "media" && len(parts) == 1:
+		atompubMediaCollection(w, r, base, c)
+	case parts[0] == "media" && len(parts) == 2:
+		atompubMediaMember(w, r, base, id, c)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func atompubService(w http.ResponseWriter, r *http.Request, base string, c appengine.Context) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := getBlogInfo(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s := Service{
+		Workspace: Workspace{
+			Title: b.Title,
+			Collections: []Collection{
+				{
+					Href:       base + "/atompub/posts",
+					Title:      "Posts",
+					Accept:     []string{atomEntryType},
+					Categories: &Categories{Fixed: "no"},
+				},
+				{
+					Href:   base + "/atompub/media",
+					Title:  "Media",
+					Accept: []string{"image/*", "audio/*", "video/*", "application/pdf"},
+				},
+			},
+		},
+	}
+	writeAtom(w, http.StatusOK, "application/atomsvc+xml", s)
+}
+
+// writeAtom writes v as an XML document
+func writeAtom(w http.ResponseWriter, status int, contentType string, v interface{}) {
+	output, err := xml.MarshalIndent(v, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType+";charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(output)
+}
+
+// writeMember writes a member entry, with its ETag. New members are also
+// located by the Location and Content-Location headers.
+func writeMember(w http.ResponseWriter, r *http.Request, status int, e Entry) {
+	etag := etagOf(e)
+	if status == http.StatusOK && notModified(w, r, etag) {
+		return
+	}
+	if status == http.StatusCreated {
+		edit := entryLink(&e, "edit")
+		w.Header().Set("Location", edit)
+		w.Header().Set("Content-Location", edit)
+	}
+	w.Header().Set("ETag", etag)
+	e.Xmlns = atomNamespace
+	writeAtom(w, status, atomEntryType, e)
+}
+
+func entryLink(e *Entry, rel string) string {
+	if e.Links != nil {
+		for _, l := range *e.Links {
+			if l.Rel == rel {
+				return l.Href
+			}
+		}
+	}
+	return ""
+}
+
+// ifMatch reports whether an update's If-Match header, if it sent one,
+// matches the member's current ETag. Unlike the JSON API, AtomPub clients
+// aren't required to send one.
+func ifMatch(w http.ResponseWriter, r *http.Request, e Entry) bool {
+	m := r.Header.Get("If-Match")
+	if m == "" || m == "*" {
+		return true
+	}
+	etag := etagOf(e)
+	for _, t := range strings.Split(m, ",") {
+		if strings.TrimSpace(t) == etag {
+			return true
+		}
+	}
+	http.Error(w, "The entry has changed", http.StatusPreconditionFailed)
+	return false
+}
+
+// collectionFeed returns a page of a collection, linked to the next page
+func collectionFeed(r *http.Request, base, title, path string, page int, entries []Entry, more bool) Feed {
+	self := base + path
+	f := Feed{
+		Xmlns:   atomNamespace,
+		Title:   title,
+		Id:      feedID(r.Host) + strings.Replace(path, "/", ".", -1),
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Links:   &[]Link{{Rel: "self", Href: self}},
+		Entries: &entries,
+	}
+	if more {
+		next := Link{Rel: "next", Href: self + "?page=" + strconv.Itoa(page+1)}
+		*f.Links = append(*f.Links, next)
+	}
+	return f
+}
+
+func postEntry(host, base string, p *Post, id int64) Entry {
+	idStr := strconv.FormatInt(id, 10)
+	updated := p.Updated
+	if updated.IsZero() {
+		updated = p.Date
+	}
+
+	e := Entry{
+		Title:     p.Title,
+		Summary:   p.Description,
+		Id:        feedID(host) + ".post-" + idStr,
+		Updated:   atomTime(updated),
+		Published: atomTime(p.Date),
+		Edited:    atomTime(updated),
+		Links: &[]Link{
+			{Rel: "alternate", Href: base + "/" + idStr},
+			{Rel: "edit", Href: base + "/atompub/posts/" + idStr},
+		},
+		Content: &Content{Type: "text", Content: p.Lead + p.Content},
+	}
+	for _, t := range p.Tags {
+		e.Categories = append(e.Categories, Category{Term: t})
+	}
+	if p.Hidden {
+		e.Control = &Control{Draft: "yes"}
+	}
+	return e
+}
+
+// readEntry reads a posted atom:entry into a post
+func readEntry(w http.ResponseWriter, r *http.Request, p *Post) bool {
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/atom+xml" {
+		http.Error(w, "Posts must be sent as "+atomEntryType, http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 4<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	e := Entry{}
+	if err := xml.Unmarshal(body, &e); err != nil {
+		http.Error(w, "Malformed entry: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	content := ""
+	if e.Content != nil {
+		switch {
+		case e.Content.Src != "":
+			http.Error(w, "Posts can't have out of line content", http.StatusBadRequest)
+			return false
+		case e.Content.Type == "xhtml":
+			http.Error(w, "xhtml content isn't supported, send text or html", http.StatusUnsupportedMediaType)
+			return false
+		}
+		content = e.Content.Content
+	}
+
+	p.Title = strings.TrimSpace(e.Title)
+	p.Description = strings.TrimSpace(e.Summary)
+	p.Lead, p.Content = splitLead(content)
+	p.Hidden = e.Control != nil && strings.TrimSpace(e.Control.Draft) == "yes"
+
+	tags := make([]string, 0, len(e.Categories))
+	for _, c := range e.Categories {
+		tags = append(tags, c.Term)
+	}
+	p.Tags = cleanTags(tags)
+
+	if e.Published != "" {
+		d, err := time.Parse(time.RFC3339, strings.TrimSpace(e.Published))
+		if err != nil {
+			http.Error(w, "Bad published date: "+err.Error(), http.StatusBadRequest)
+			return false
+		}
+		p.Date = d
+	}
+	if p.Date.IsZero() {
+		p.Date = time.Now()
+	}
+	return true
+}
+
+func atompubPosts(w http.ResponseWriter, r *http.Request, base string, cl caller, c appengine.Context) {
+	switch r.Method {
+	case "GET":
+		page, _ := strconv.Atoi(r.FormValue("page"))
+		if page < 1 {
+			page = 1
+		}
+
+		p := make([]Post, 0, atompubPerPage+1)
+		q := datastore.NewQuery("Post").Order("-Date").Offset((page - 1) * atompubPerPage).Limit(atompubPerPage + 1)
+		keys, err := q.GetAll(c, &p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		more := len(p) > atompubPerPage
+		if more {
+			p = p[:atompubPerPage]
+		}
+		entries := make([]Entry, len(p))
+		for i := range p {
+			entries[i] = postEntry(r.Host, base, &p[i], keys[i].IntID())
+		}
+		writeAtom(w, http.StatusOK, atomFeedType, collectionFeed(r, base, "Posts", "/atompub/posts", page, entries, more))
+
+	case "POST":
+		p := Post{AuthorID: cl.AuthorID}
+		if !readEntry(w, r, &p) {
+			return
+		}
+		if err := cl.canSave(nil, &p); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		k, err := savePost(c, datastore.NewIncompleteKey(c, "Post", nil), &p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeMember(w, r, http.StatusCreated, postEntry(r.Host, base, &p, k.IntID()))
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func atompubPost(w http.ResponseWriter, r *http.Request, base string, id int64, cl caller, c appengine.Context) {
+	k := datastore.NewKey(c, "Post", "", id, nil)
+	p := Post{}
+	if err := datastore.Get(c, k, &p); err == datastore.ErrNoSuchEntity {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e := postEntry(r.Host, base, &p, id)
+
+	switch r.Method {
+	case "GET":
+		writeMember(w, r, http.StatusOK, e)
+
+	case "PUT":
+		if !ifMatch(w, r, e) {
+			return
+		}
+		updated := Post{Date: p.Date}
+		if !readEntry(w, r, &updated) {
+			return
+		}
+		if err := cl.canSave(&p, &updated); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if _, err := savePost(c, k, &updated); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeMember(w, r, http.StatusOK, postEntry(r.Host, base, &updated, id))
+
+	case "DELETE":
+		if !ifMatch(w, r, e) {
+			return
+		}
+		if err := cl.canDelete(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		memcache.Flush(c)
+		if err := removePost(c, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// mediaEntry returns the media link entry for an upload. Its content links
+// to the file itself.
+func mediaEntry(host, base string, m *Media) Entry {
+	idStr := strconv.FormatInt(m.ID, 10)
+	e := Entry{
+		Title:   m.Name,
+		Id:      feedID(host) + ".media-" + idStr,
+		Updated: atomTime(m.Date),
+		Edited:  atomTime(m.Date),
+		Links: &[]Link{
+			{Rel: "edit", Href: base + "/atompub/media/" + idStr},
+		},
+		Content: &Content{Type: m.ContentType, Src: base + m.URL},
+	}
+	if m.ThumbURL != "" {
+		*e.Links = append(*e.Links, Link{Rel: "related", Href: base + m.ThumbURL, Title: "Thumbnail"})
+	}
+	return e
+}
+
+func atompubMediaCollection(w http.ResponseWriter, r *http.Request, base string, c appengine.Context) {
+	switch r.Method {
+	case "GET":
+		page, _ := strconv.Atoi(r.FormValue("page"))
+		if page < 1 {
+			page = 1
+		}
+
+		m := make([]Media, 0, atompubPerPage+1)
+		q := datastore.NewQuery("Media").Order("-Date").Offset((page - 1) * atompubPerPage).Limit(atompubPerPage + 1)
+		keys, err := q.GetAll(c, &m)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		more := len(m) > atompubPerPage
+		if more {
+			m = m[:atompubPerPage]
+		}
+		entries := make([]Entry, len(m))
+		for i := range m {
+			m[i].ID = keys[i].IntID()
+			m[i].setURLs()
+			entries[i] = mediaEntry(r.Host, base, &m[i])
+		}
+		writeAtom(w, http.StatusOK, atomFeedType, collectionFeed(r, base, "Media", "/atompub/media", page, entries, more))
+
+	case "POST":
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, inlineMediaMax+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The Slug header suggests a name, percent-encoded
+		name, _ := url.QueryUnescape(r.Header.Get("Slug"))
+		m, err := putInlineMedia(c, name, r.Header.Get("Content-Type"), data)
+		if err == errMediaSize {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeMember(w, r, http.StatusCreated, mediaEntry(r.Host, base, &m))
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func atompubMediaMember(w http.ResponseWriter, r *http.Request, base string, id int64, c appengine.Context) {
+	m, err := getMedia(id, c)
+	if err == datastore.ErrNoSuchEntity {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e := mediaEntry(r.Host, base, &m)
+
+	switch r.Method {
+	case "GET":
+		writeMember(w, r, http.StatusOK, e)
+
+	case "PUT":
+		// Only the title, which is the file's name, can be changed
+		if !ifMatch(w, r, e) {
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		updated := Entry{}
+		if err := xml.Unmarshal(body, &updated); err != nil {
+			http.Error(w, "Malformed entry: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.Name = strings.TrimSpace(updated.Title)
+		if _, err := datastore.Put(c, datastore.NewKey(c, "Media", "", id, nil), &m); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeMember(w, r, http.StatusOK, mediaEntry(r.Host, base, &m))
+
+	case "DELETE":
+		if !ifMatch(w, r, e) {
+			return
+		}
+		if err := removeMedia(c, &m); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,200 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+)
+
+/*
+ *  Logins. Who is logged in comes from the configured authProvider. On App
+ *  Engine that's the Users service, and Google accounts; standalone
+ *  deployments, which have no Users service, set DINGHY_AUTH=local to use the
+ *  blog's own accounts instead (see localauth.go). Either way, administrators
+ *  are owners, and other logins take the Role of the author whose Login they
+ *  are (see roles.go).
+ *
+ *  Logins are carried by cookies, which browsers send with requests from any
+ *  site, so requests that change anything must also carry a CSRF token
+ *  derived from the login. The admin page fetches it from /session, and sends
+ *  it as an X-CSRF-Token header, or a "csrf" form value. GETs aren't checked,
+ *  so handlers that change anything only accept POSTs, or other unsafe
+ *  methods. API tokens aren't sent automatically, so requests authenticated
+ *  by one don't need it.
+ */
+
+// An authUser is a logged in user
+type authUser struct {
+	// Matched against authors' logins
+	Login string
+	// Administrators are owners
+	Admin bool
+	// Identifies this login, to derive its CSRF token
+	ID string
+}
+
+// An authProvider knows who is logged in, and where they log in and out
+type authProvider interface {
+	// current returns the logged in user, or nil if there isn't one
+	current(c appengine.Context, r *http.Request) *authUser
+	// loginURL returns the address of the login page, which returns to dest
+	loginURL(c appengine.Context, r *http.Request, dest string) (string, error)
+	// logoutURL returns an address that logs the user out, then goes to dest
+	logoutURL(c appengine.Context, r *http.Request, dest string) (string, error)
+}
+
+var auth authProvider = appEngineAuth{}
+
+func init() {
+	if os.Getenv("DINGHY_AUTH") == "local" {
+		auth = localAuth{}
+	}
+}
+
+// Logins through the App Engine Users service
+type appEngineAuth struct{}
+
+func (appEngineAuth) current(c appengine.Context, r *http.Request) *authUser {
+	u := user.Current(c)
+	if u == nil {
+		return nil
+	}
+	return &authUser{Login: u.Email, Admin: user.IsAdmin(c), ID: u.ID + ":" + u.Email}
+}
+
+func (appEngineAuth) loginURL(c appengine.Context, r *http.Request, dest string) (string, error) {
+	return user.LoginURL(c, dest)
+}
+
+func (appEngineAuth) logoutURL(c appengine.Context, r *http.Request, dest string) (string, error) {
+	return user.LogoutURL(c, dest)
+}
+
+// A Secret is a random key kept in the datastore, named by its use
+type Secret struct {
+	Value []byte `datastore:",noindex"`
+}
+
+// siteSecret returns the named secret, creating it on first use
+func siteSecret(c appengine.Context, name string) ([]byte, error) {
+	s := Secret{}
+	k := datastore.NewKey(c, "Secret", name, 0, nil)
+	if err := datastore.Get(c, k, &s); err != datastore.ErrNoSuchEntity {
+		return s.Value, err
+	}
+
+	// Concurrent first uses must agree on one secret
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		err := datastore.Get(tc, k, &s)
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		s.Value = make([]byte, 32)
+		if _, err := rand.Read(s.Value); err != nil {
+			return err
+		}
+		_, err = datastore.Put(tc, k, &s)
+		return err
+	}, nil)
+	return s.Value, err
+}
+
+// csrfToken returns the CSRF token for a login
+func csrfToken(c appengine.Context, u *authUser) (string, error) {
+	key, err := siteSecret(c, "csrf")
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(u.ID))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// validCSRF reports whether a request from a logged in user is safe, or
+// carries their CSRF token. Only urlencoded forms are searched for a "csrf"
+// value, as reading other bodies would consume them before their handler.
+func validCSRF(c appengine.Context, r *http.Request, u *authUser) bool {
+	if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+		return true
+	}
+
+	sent := r.Header.Get("X-CSRF-Token")
+	if sent == "" {
+		if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t == "application/x-www-form-urlencoded" {
+			sent = r.PostFormValue("csrf")
+		}
+	}
+	want, err := csrfToken(c, u)
+	if err != nil {
+		c.Errorf("Deriving CSRF token: %v", err)
+		return false
+	}
+	return sent != "" && hmac.Equal([]byte(sent), []byte(want))
+}
+
+// sessionInfo describes the current login to the admin page: who it is, their
+// role, their CSRF token, and where to log in or out
+type sessionInfo struct {
+	Login     string
+	Role      string
+	CSRF      string
+	LoginURL  string `json:",omitempty"`
+	LogoutURL string `json:",omitempty"`
+	// Whether the blog has its own accounts
+	Local bool
+}
+
+// AJAX functions
+
+// currentSession returns the current login's sessionInfo as JSON. Without a
+// login, it only has the LoginURL, which comes back to the page given as
+// "continue".
+func currentSession(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	dest := localPath(r.FormValue("continue"), "/admin")
+	_, local := auth.(localAuth)
+	s := sessionInfo{Local: local}
+
+	u := auth.current(c, r)
+	var err error
+	if u == nil {
+		s.LoginURL, err = auth.loginURL(c, r, dest)
+	} else {
+		s.Login = u.Login
+		s.Role = loginCaller(c, u).Role
+		if s.CSRF, err = csrfToken(c, u); err == nil {
+			s.LogoutURL, err = auth.logoutURL(c, r, "/")
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Never cache a CSRF token
+	w.Header().Set("Cache-Control", "no-store")
+	j, err := json.Marshal(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
+
+// localPath returns dest if it's a path on this site, so that redirects can't
+// send users elsewhere, or def if it isn't
+func localPath(dest, def string) string {
+	if len(dest) == 0 || dest[0] != '/' || (len(dest) > 1 && (dest[1] == '/' || dest[1] == '\\')) {
+		return def
+	}
+	return dest
+}
@@ -0,0 +1,232 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+/*
+ *  Authors. Each post may be attributed to one of the blog's authors, by the
+ *  key name of their Author entity, which is also their page's address,
+ *  "/author/NAME". Posts are attributed when they're created, to the author
+ *  whose Login matches whoever created them: an App Engine user, by email
+ *  address, or an API token, by name. Posts without an author, or whose
+ *  author has been deleted, are shown under the blog's Author setting. An
+ *  author's Role decides what their login may do (see roles.go).
+ */
+
+// An AuthorProfile is one of the blog's authors, stored as an Author entity.
+// (Author is the Atom element.)
+type AuthorProfile struct {
+	Name   string
+	Bio    string `datastore:",noindex"`
+	Avatar string `datastore:",noindex"`
+	Email  string `datastore:",noindex"`
+	Login  string
+	Role   string `datastore:",noindex"`
+	ID     string `datastore:"-"`
+}
+
+// authorPrefix starts the paths of author pages
+const authorPrefix = "author/"
+
+var authorIDRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// authorPath returns the address of an author's page
+func authorPath(id string) string {
+	return "/" + authorPrefix + url.PathEscape(id)
+}
+
+// authorID derives a new author's key name from their name
+func authorID(name string) string {
+	return strings.Trim(authorIDRe.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+func authorKey(c appengine.Context, id string) *datastore.Key {
+	return datastore.NewKey(c, "Author", id, 0, nil)
+}
+
+func getAuthor(c appengine.Context, id string) (AuthorProfile, error) {
+	a := AuthorProfile{}
+	if id == "" {
+		return a, datastore.ErrNoSuchEntity
+	}
+	if err := datastore.Get(c, authorKey(c, id), &a); err != nil {
+		return a, err
+	}
+	a.ID = id
+	return a, nil
+}
+
+// getPostAuthor fills in the author of a post, if it has one
+func getPostAuthor(c appengine.Context, p *Post) error {
+	a, err := getAuthor(c, p.AuthorID)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	p.Author = &a
+	return nil
+}
+
+// loginAuthor returns the ID of the author with the given login, or blank if
+// there isn't one
+func loginAuthor(c appengine.Context, login string) string {
+	if a := loginProfile(c, login); a != nil {
+		return a.ID
+	}
+	return ""
+}
+
+// role returns the author's role, by default an author
+func (a *AuthorProfile) role() string {
+	if a.Role == "" {
+		return defaultRole
+	}
+	return a.Role
+}
+
+func validateAuthor(a *AuthorProfile) error {
+	a.Name = strings.TrimSpace(a.Name)
+	a.Avatar = strings.TrimSpace(a.Avatar)
+	a.Email = strings.TrimSpace(a.Email)
+	a.Login = strings.TrimSpace(a.Login)
+
+	if a.Name == "" {
+		return fmt.Errorf("An author name is required")
+	}
+	if a.Avatar != "" {
+		u, err := url.Parse(a.Avatar)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && !strings.HasPrefix(a.Avatar, "/")) {
+			return fmt.Errorf("Avatar %q is not an http or https URL, or a path", a.Avatar)
+		}
+	}
+	if a.Email != "" && !strings.Contains(a.Email, "@") {
+		return fmt.Errorf("%q is not an email address", a.Email)
+	}
+	if a.Role != "" && roleRank[a.Role] == 0 {
+		return fmt.Errorf("Unknown role: %s", a.Role)
+	}
+	return nil
+}
+
+// AJAX functions
+
+// authors lists authors on GET. On POST, the "action" form value "save"
+// creates or updates the author with the given ID, and "delete" deletes it.
+// New authors' IDs are derived from their names.
+func authors(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	switch r.FormValue("action") {
+	case "":
+		a := make([]AuthorProfile, 0)
+		keys, err := datastore.NewQuery("Author").Order("Name").GetAll(c, &a)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i := range a {
+			a[i].ID = keys[i].StringID()
+		}
+
+		j, err := json.Marshal(a)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%s", j)
+
+	case "save":
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		a := AuthorProfile{
+			Name:   r.FormValue("Name"),
+			Bio:    r.FormValue("Bio"),
+			Avatar: r.FormValue("Avatar"),
+			Email:  r.FormValue("Email"),
+			Login:  r.FormValue("Login"),
+			Role:   r.FormValue("Role"),
+		}
+		if err := validateAuthor(&a); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		id := r.FormValue("ID")
+		create := id == ""
+		if create {
+			if id = authorID(a.Name); id == "" {
+				http.Error(w, "An author name needs letters or digits", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Each login posts as one author
+		if other := loginAuthor(c, a.Login); other != "" && other != id {
+			http.Error(w, "Login "+a.Login+" already belongs to another author", http.StatusConflict)
+			return
+		}
+
+		k := authorKey(c, id)
+		err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+			err := datastore.Get(tc, k, &AuthorProfile{})
+			switch {
+			case err != nil && err != datastore.ErrNoSuchEntity:
+				return err
+			case create && err == nil:
+				return fmt.Errorf("An author with ID %s already exists", id)
+			case !create && err != nil:
+				return err
+			}
+			_, err = datastore.Put(tc, k, &a)
+			return err
+		}, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Author names are on pages and in feeds
+		flushAuthorChange(c)
+		fmt.Fprint(w, "success")
+
+	case "delete":
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Their posts fall back to the blog's author
+		if err := datastore.Delete(c, authorKey(c, r.FormValue("ID"))); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		flushAuthorChange(c)
+		fmt.Fprint(w, "success")
+
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+	}
+}
+
+// flushAuthorChange discards the cached pages and feeds that may name an
+// author
+func flushAuthorChange(c appengine.Context) {
+	if err := memcache.Flush(c); err != nil {
+		c.Warningf("Flushing memcache: %v", err)
+	}
+	expireFeed(c)
+	expireArchives(c)
+}
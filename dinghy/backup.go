@@ -0,0 +1,416 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+/*
+ *  Backup and restore of the whole blog. "/admin/backup" streams every
+ *  entity as JSON lines: a header naming the format and its version, one
+ *  line per entity, and a trailer with the entity count, whose absence marks
+ *  a truncated archive. Entities are written property by property rather
+ *  than through their Go types, so fields kept out of JSON elsewhere, such
+ *  as commenters' addresses and inline media, survive the round trip.
+ *
+ *  "/admin/restore" checks the whole archive, including that each entity
+ *  loads into its Go type, before writing any of it. In "merge" mode,
+ *  archived entities overwrite those with the same key and others are kept;
+ *  in "replace" mode, the existing blog is deleted first. The search index
+ *  isn't archived, and is rebuilt afterwards.
+ *
+ *  Files held in the blobstore or media directory aren't included, only
+ *  their Media entities, so restoring to another app means copying them too.
+ */
+
+const (
+	backupFormat  = "dinghy-backup"
+	backupVersion = 1
+	// Entities written or deleted per datastore call
+	backupBatch = 500
+)
+
+// The kinds archived, parents before children, and the types they load into
+var backupKinds = []string{"Blog", "Post", "Comment", "Mention", "Media", "Redirect", "Token", "Author", "Account", "Feed"}
+
+var backupTypes = map[string]func() interface{}{
+	"Blog":     func() interface{} { return &Blog{} },
+	"Post":     func() interface{} { return &Post{} },
+	"Comment":  func() interface{} { return &Comment{} },
+	"Mention":  func() interface{} { return &Mention{} },
+	"Media":    func() interface{} { return &Media{} },
+	"Redirect": func() interface{} { return &Redirect{} },
+	"Token":    func() interface{} { return &Token{} },
+	"Author":   func() interface{} { return &AuthorProfile{} },
+	"Account":  func() interface{} { return &Account{} },
+	"Feed":     func() interface{} { return &RawFeed{} },
+}
+
+// The first line of an archive
+type backupHeader struct {
+	Format  string
+	Version int
+	Created time.Time
+	Host    string
+}
+
+// A backupRecord is an entity, or the trailer, which has End set
+type backupRecord struct {
+	Key        []backupKeyPart  `json:",omitempty"`
+	Properties []backupProperty `json:",omitempty"`
+	End        bool             `json:",omitempty"`
+	Count      int              `json:",omitempty"`
+}
+
+// Keys are stored as paths, rather than encoded, since an encoded key
+// includes the app ID, which differs when restoring elsewhere
+type backupKeyPart struct {
+	Kind string
+	Name string `json:",omitempty"`
+	ID   int64  `json:",omitempty"`
+}
+
+type backupProperty struct {
+	Name     string
+	Type     string
+	Value    json.RawMessage
+	NoIndex  bool `json:",omitempty"`
+	Multiple bool `json:",omitempty"`
+}
+
+// RestoreReport describes a completed restore
+type RestoreReport struct {
+	Mode     string
+	Restored map[string]int
+	Deleted  int
+	Indexed  int
+}
+
+var errTruncatedBackup = errors.New("The backup is incomplete, as it has no trailer")
+
+// encodeProperty converts a property to its archived form
+func encodeProperty(p datastore.Property) (backupProperty, error) {
+	bp := backupProperty{Name: p.Name, NoIndex: p.NoIndex, Multiple: p.Multiple}
+
+	var v interface{}
+	switch pv := p.Value.(type) {
+	case nil:
+		bp.Type = "null"
+	case string:
+		bp.Type, v = "string", pv
+	case int64:
+		bp.Type, v = "int", pv
+	case float64:
+		bp.Type, v = "float", pv
+	case bool:
+		bp.Type, v = "bool", pv
+	case time.Time:
+		bp.Type, v = "time", pv.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		bp.Type, v = "bytes", base64.StdEncoding.EncodeToString(pv)
+	case appengine.BlobKey:
+		bp.Type, v = "blobkey", string(pv)
+	case *datastore.Key:
+		bp.Type, v = "key", keyPath(pv)
+	default:
+		return bp, fmt.Errorf("Property %s has unsupported type %T", p.Name, p.Value)
+	}
+
+	var err error
+	bp.Value, err = json.Marshal(v)
+	return bp, err
+}
+
+// decodeProperty converts an archived property back
+func decodeProperty(c appengine.Context, bp backupProperty) (datastore.Property, error) {
+	p := datastore.Property{Name: bp.Name, NoIndex: bp.NoIndex, Multiple: bp.Multiple}
+	if bp.Name == "" {
+		return p, errors.New("Property has no name")
+	}
+
+	var err error
+	switch bp.Type {
+	case "null":
+	case "string":
+		var s string
+		err = json.Unmarshal(bp.Value, &s)
+		p.Value = s
+	case "int":
+		var i int64
+		err = json.Unmarshal(bp.Value, &i)
+		p.Value = i
+	case "float":
+		var f float64
+		err = json.Unmarshal(bp.Value, &f)
+		p.Value = f
+	case "bool":
+		var b bool
+		err = json.Unmarshal(bp.Value, &b)
+		p.Value = b
+	case "time":
+		var s string
+		var t time.Time
+		if err = json.Unmarshal(bp.Value, &s); err == nil {
+			t, err = time.Parse(time.RFC3339Nano, s)
+		}
+		p.Value = t
+	case "bytes":
+		var s string
+		var b []byte
+		if err = json.Unmarshal(bp.Value, &s); err == nil {
+			b, err = base64.StdEncoding.DecodeString(s)
+		}
+		p.Value = b
+	case "blobkey":
+		var s string
+		err = json.Unmarshal(bp.Value, &s)
+		p.Value = appengine.BlobKey(s)
+	case "key":
+		var path []backupKeyPart
+		var k *datastore.Key
+		if err = json.Unmarshal(bp.Value, &path); err == nil {
+			k, err = pathKey(c, path)
+		}
+		p.Value = k
+	default:
+		err = fmt.Errorf("unknown type %q", bp.Type)
+	}
+	if err != nil {
+		return p, fmt.Errorf("Property %s: %v", bp.Name, err)
+	}
+	return p, nil
+}
+
+func keyPath(k *datastore.Key) []backupKeyPart {
+	var path []backupKeyPart
+	for ; k != nil; k = k.Parent() {
+		path = append([]backupKeyPart{{k.Kind(), k.StringID(), k.IntID()}}, path...)
+	}
+	return path
+}
+
+func pathKey(c appengine.Context, path []backupKeyPart) (*datastore.Key, error) {
+	if len(path) == 0 {
+		return nil, errors.New("Empty key")
+	}
+	var k *datastore.Key
+	for _, part := range path {
+		if part.Kind == "" || (part.Name == "") == (part.ID == 0) {
+			return nil, fmt.Errorf("Invalid key part %+v", part)
+		}
+		k = datastore.NewKey(c, part.Kind, part.Name, part.ID, k)
+	}
+	return k, nil
+}
+
+// loads reports whether an entity's properties load into its kind's Go type
+func loads(kind string, props datastore.PropertyList) error {
+	ch := make(chan datastore.Property, len(props))
+	for _, p := range props {
+		ch <- p
+	}
+	close(ch)
+	return datastore.LoadStruct(backupTypes[kind](), ch)
+}
+
+// readBackup reads and checks a whole archive
+func readBackup(c appengine.Context, r io.Reader) ([]*datastore.Key, []datastore.PropertyList, error) {
+	d := json.NewDecoder(r)
+
+	h := backupHeader{}
+	if err := d.Decode(&h); err != nil {
+		return nil, nil, fmt.Errorf("Reading header: %v", err)
+	}
+	switch {
+	case h.Format != backupFormat:
+		return nil, nil, errors.New("Not a Dinghy backup")
+	case h.Version < 1 || h.Version > backupVersion:
+		return nil, nil, fmt.Errorf("Backup version %d is not supported; this blog reads version %d", h.Version, backupVersion)
+	}
+
+	keys := make([]*datastore.Key, 0)
+	entities := make([]datastore.PropertyList, 0)
+	for {
+		rec := backupRecord{}
+		if err := d.Decode(&rec); err == io.EOF {
+			return nil, nil, errTruncatedBackup
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("Reading entity %d: %v", len(keys)+1, err)
+		}
+
+		if rec.End {
+			if rec.Count != len(keys) {
+				return nil, nil, fmt.Errorf("The backup has %d entities, but its trailer says %d", len(keys), rec.Count)
+			}
+			if err := d.Decode(&rec); err != io.EOF {
+				return nil, nil, errors.New("The backup continues after its trailer")
+			}
+			return keys, entities, nil
+		}
+
+		k, err := pathKey(c, rec.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Entity %d: %v", len(keys)+1, err)
+		}
+		if backupTypes[k.Kind()] == nil {
+			return nil, nil, fmt.Errorf("Entity %d has unknown kind %q", len(keys)+1, k.Kind())
+		}
+
+		props := make(datastore.PropertyList, len(rec.Properties))
+		for i, bp := range rec.Properties {
+			if props[i], err = decodeProperty(c, bp); err != nil {
+				return nil, nil, fmt.Errorf("%s entity %d: %v", k.Kind(), len(keys)+1, err)
+			}
+		}
+		if err := loads(k.Kind(), props); err != nil {
+			return nil, nil, fmt.Errorf("%s entity %d doesn't match this version of Dinghy: %v", k.Kind(), len(keys)+1, err)
+		}
+
+		keys = append(keys, k)
+		entities = append(entities, props)
+	}
+}
+
+// deleteAll deletes every entity of the archived kinds, and the search index
+func deleteAll(c appengine.Context) (int, error) {
+	n := 0
+	for _, kind := range append(backupKinds, "PostIndex") {
+		keys, err := datastore.NewQuery(kind).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return n, err
+		}
+		for i := 0; i < len(keys); i += backupBatch {
+			end := i + backupBatch
+			if end > len(keys) {
+				end = len(keys)
+			}
+			if err := datastore.DeleteMulti(c, keys[i:end]); err != nil {
+				return n, err
+			}
+			n += end - i
+		}
+	}
+	return n, nil
+}
+
+// AJAX functions
+
+// backup streams the archive. An error part way through can only be logged,
+// and leaves the archive without its trailer.
+func backup(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	now := time.Now()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="dinghy-backup-%s.jsonl"`, now.Format("2006-01-02")))
+
+	enc := json.NewEncoder(w)
+	h := backupHeader{backupFormat, backupVersion, now, appengine.DefaultVersionHostname(c)}
+	if err := enc.Encode(h); err != nil {
+		c.Errorf("Writing backup: %v", err)
+		return
+	}
+
+	n := 0
+	for _, kind := range backupKinds {
+		t := datastore.NewQuery(kind).Run(c)
+		for {
+			var props datastore.PropertyList
+			k, err := t.Next(&props)
+			if err == datastore.Done {
+				break
+			}
+
+			rec := backupRecord{Key: keyPath(k), Properties: make([]backupProperty, len(props))}
+			for i := 0; err == nil && i < len(props); i++ {
+				rec.Properties[i], err = encodeProperty(props[i])
+			}
+			if err == nil {
+				err = enc.Encode(rec)
+			}
+			if err != nil {
+				c.Errorf("Writing backup, at %s entity %d: %v", kind, n+1, err)
+				return
+			}
+			n++
+		}
+	}
+
+	if err := enc.Encode(backupRecord{End: true, Count: n}); err != nil {
+		c.Errorf("Writing backup: %v", err)
+	}
+}
+
+// restore loads the archive uploaded as "file", in the given "mode", merge
+// or replace, and returns a RestoreReport as JSON
+func restore(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mode := r.FormValue("mode")
+	if mode != "merge" && mode != "replace" {
+		http.Error(w, `mode must be "merge" or "replace"`, http.StatusBadRequest)
+		return
+	}
+
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "No backup file was uploaded: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+
+	keys, entities, err := readBackup(c, f)
+	if err != nil {
+		http.Error(w, "Invalid backup: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report := RestoreReport{Mode: mode, Restored: map[string]int{}}
+	if mode == "replace" {
+		if report.Deleted, err = deleteAll(c); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	for i := 0; i < len(keys); i += backupBatch {
+		end := i + backupBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if _, err := datastore.PutMulti(c, keys[i:end], entities[i:end]); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, k := range keys[i:end] {
+			report.Restored[k.Kind()]++
+		}
+	}
+
+	memcache.Flush(c)
+	if report.Indexed, err = indexAll(c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
@@ -0,0 +1,281 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Comments are stored as children of the Post they belong to, so approved
+// comments for a single post can be fetched with an ancestor query.
+type Comment struct {
+	Author   string
+	Email    string `datastore:",noindex"`
+	URL      string `datastore:",noindex"`
+	Content  string `datastore:",noindex"`
+	IP       string `datastore:",noindex" json:"-"`
+	Date     time.Time
+	Approved bool
+	Rejected bool
+	Key      string `datastore:"-"`
+	PostID   int64  `datastore:"-"`
+}
+
+const (
+	// Maximum number of comments accepted from a single address...
+	commentRateLimit = 5
+	// ...within this window
+	commentRateWindow = 10 * time.Minute
+	// Hidden form field that only bots fill in
+	commentHoneypot = "Subject"
+)
+
+// postComment accepts a comment from a reader. New comments are always placed
+// in the moderation queue, and are not visible until approved.
+func postComment(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Pretend the honeypot submission worked, so bots don't learn to avoid it
+	if r.FormValue(commentHoneypot) != "" {
+		fmt.Fprint(w, "success")
+		return
+	}
+
+	ip := remoteIP(r)
+	if !allowComment(c, ip) {
+		http.Error(w, "Too many comments, please try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("PostID"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cm := Comment{
+		Author:  strings.TrimSpace(r.FormValue("Author")),
+		Email:   strings.TrimSpace(r.FormValue("Email")),
+		URL:     strings.TrimSpace(r.FormValue("URL")),
+		Content: strings.TrimSpace(r.FormValue("Content")),
+		IP:      ip,
+		Date:    time.Now(),
+	}
+
+	if cm.Author == "" || cm.Content == "" {
+		http.Error(w, "Name and comment are required", http.StatusBadRequest)
+		return
+	}
+
+	if cm.URL != "" && !strings.HasPrefix(cm.URL, "http://") && !strings.HasPrefix(cm.URL, "https://") {
+		cm.URL = "http://" + cm.URL
+	}
+
+	// Comments can only be left on posts the reader could see
+	pk := datastore.NewKey(c, "Post", "", id, nil)
+	p := Post{}
+	if err := datastore.Get(c, pk, &p); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if p.Hidden {
+		http.Error(w, "Comments are closed for this post", http.StatusForbidden)
+		return
+	}
+
+	k := datastore.NewIncompleteKey(c, "Comment", pk)
+	if _, err := datastore.Put(c, k, &cm); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprint(w, "success")
+}
+
+// remoteIP returns the address a request came from, without its port, which
+// differs for each connection
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allowComment counts comments per remote address in memcache. The counter is
+// created with an expiration, so the window starts at the first comment.
+func allowComment(c appengine.Context, addr string) bool {
+	key := "comment.rate." + addr
+	memcache.Add(c, &memcache.Item{
+		Key:        key,
+		Value:      []byte("0"),
+		Expiration: commentRateWindow,
+	})
+
+	n, err := memcache.Increment(c, key, 1, 0)
+	if err != nil {
+		// Fail open; the moderation queue is the real line of defense
+		return true
+	}
+	return n <= commentRateLimit
+}
+
+// getComments returns the approved comments for a post, oldest first.
+func getComments(id int64, c appengine.Context) ([]Comment, error) {
+	cm := make([]Comment, 0)
+	pk := datastore.NewKey(c, "Post", "", id, nil)
+	q := datastore.NewQuery("Comment").Ancestor(pk).Filter("Approved =", true).Order("Date")
+
+	keys, err := q.GetAll(c, &cm)
+	if err != nil {
+		return cm, err
+	}
+
+	for i := 0; i < len(cm); i++ {
+		cm[i].Key = keys[i].Encode()
+		cm[i].PostID = id
+	}
+	return cm, nil
+}
+
+// AJAX functions
+
+// listComments returns the moderation queue as JSON. The "status" form value
+// selects pending (the default), approved, or rejected comments.
+func listComments(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cm := make([]Comment, 0)
+
+	q := datastore.NewQuery("Comment")
+	switch r.FormValue("status") {
+	case "approved":
+		q = q.Filter("Approved =", true)
+	case "rejected":
+		q = q.Filter("Rejected =", true)
+	default:
+		q = q.Filter("Approved =", false).Filter("Rejected =", false)
+	}
+	q = q.Order("-Date").Limit(100)
+
+	keys, err := q.GetAll(c, &cm)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := 0; i < len(cm); i++ {
+		cm[i].Key = keys[i].Encode()
+		cm[i].PostID = keys[i].Parent().IntID()
+	}
+
+	j, err := json.Marshal(cm)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "%s", j)
+}
+
+// moderate approves, rejects, or deletes a single comment, identified by its
+// encoded datastore key. The parent post's CommentCount is kept in step with
+// the number of approved comments, in the same transaction.
+func moderate(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	k, err := datastore.DecodeKey(r.FormValue("Key"))
+	if err != nil || k.Kind() != "Comment" {
+		http.Error(w, "Invalid comment key", http.StatusBadRequest)
+		return
+	}
+
+	action := r.FormValue("action")
+	if action != "approve" && action != "reject" && action != "delete" {
+		http.Error(w, "Unknown action: "+action, http.StatusBadRequest)
+		return
+	}
+
+	changed := false
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		cm := Comment{}
+		if err := datastore.Get(tc, k, &cm); err != nil {
+			return err
+		}
+		wasApproved := cm.Approved
+
+		switch action {
+		case "approve":
+			cm.Approved, cm.Rejected = true, false
+		case "reject":
+			cm.Approved, cm.Rejected = false, true
+		}
+
+		if action == "delete" {
+			if err := datastore.Delete(tc, k); err != nil {
+				return err
+			}
+		} else if _, err := datastore.Put(tc, k, &cm); err != nil {
+			return err
+		}
+
+		delta := 0
+		switch {
+		case cm.Approved && !wasApproved:
+			delta = 1
+		case wasApproved && (!cm.Approved || action == "delete"):
+			delta = -1
+		}
+		if delta == 0 {
+			return nil
+		}
+
+		p := Post{}
+		pk := k.Parent()
+		if err := datastore.Get(tc, pk, &p); err != nil {
+			return err
+		}
+		p.CommentCount += delta
+		if p.CommentCount < 0 {
+			p.CommentCount = 0
+		}
+		if _, err := datastore.Put(tc, pk, &p); err != nil {
+			return err
+		}
+		changed = true
+		return nil
+	}, nil)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Only a change in the approved count alters rendered pages
+	if changed {
+		expirePost(c, k.Parent().IntID())
+	}
+
+	fmt.Fprint(w, "success")
+}
+
+// expirePost removes the cached copy of a post page
+func expirePost(c appengine.Context, id int64) {
+	memcache.Delete(c, "post."+strconv.FormatInt(id, 10))
+}
@@ -4,7 +4,6 @@ import (
 	"appengine"
 	"appengine/datastore"
 	"appengine/memcache"
-	"appengine/user"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -18,13 +17,22 @@ import (
 )
 
 type Post struct {
-	Title       string
-	Description string
-	Lead        string
-	Content     string    `datastore:",noindex"`
-	ID          int64     `datastore:"-"`
-	Date        time.Time
-	Hidden	    bool
+	Title        string
+	Description  string
+	Lead         string
+	Content      string    `datastore:",noindex"`
+	ID           int64     `datastore:"-"`
+	Date         time.Time
+	Updated      time.Time
+	Hidden       bool
+	Tags         []string
+	Slug         string    `datastore:",noindex"`
+	AuthorID     string
+	CommentCount int       `datastore:",noindex"`
+	Comments     []Comment `datastore:"-"`
+	Mentions     []Mention `datastore:"-"`
+	Snippet      string    `datastore:"-" json:",omitempty"`
+	Author       *AuthorProfile `datastore:"-" json:",omitempty"`
 }
 
 // A singleton datastore object containing a blog description
@@ -33,37 +41,93 @@ type Blog struct {
 	Author      string `datastore:",noindex"`
 	Title       string `datastore:",noindex"`
 	Template    string `datastore:",noindex"`
+	Embeds      []EmbedProvider `datastore:",noindex"`
+	Hubs        []string `datastore:",noindex"`
+	BaseURL     string `datastore:",noindex"`
+	CacheControl []CacheRule `datastore:",noindex"`
 	Posts       []Post `datastore:"-"`
 	Admin       bool   `datastore:"-"`
 	Single      bool   `datastore:"-"`
+	Search      bool   `datastore:"-"`
+	Query       string `datastore:"-"`
+	Archive     bool   `datastore:"-"`
+	Period      string `datastore:"-"`
+	Tag         string `datastore:"-"`
+	Profile     *AuthorProfile `datastore:"-"`
 }
 
 func init() {
 	// Ajax functions
-	// post and init should have "login: admin" security in app.yaml
-	http.HandleFunc("/load", load)
-	http.HandleFunc("/post", post)
-	http.HandleFunc("/init", config)
+	// These are reachable by callers whose role has the given permission (see
+	// roles.go): App Engine administrators, authors' Google accounts, or API
+	// tokens
+	http.HandleFunc("/load", authorize(permRead, load))
+	http.HandleFunc("/post", authorize(permDraft, post))
+	http.HandleFunc("/init", authorize(permManage, config))
 	http.HandleFunc("/list", list)
-	http.HandleFunc("/flush", flush) // Flush memcache
-	http.HandleFunc("/preview", preview)
-	http.HandleFunc("/info", info)
-	http.HandleFunc("/verify", verifyTemplate)
-	http.HandleFunc("/delete", deletePost)
+	http.HandleFunc("/flush", authorize(permManage, flush)) // Flush memcache
+	http.HandleFunc("/preview", authorize(permDraft, preview))
+	http.HandleFunc("/info", authorize(permRead, info))
+	http.HandleFunc("/verify", authorize(permManage, verifyTemplate))
+	http.HandleFunc("/delete", authorize(permDraft, deletePost))
+	http.HandleFunc("/comments", authorize(permModerate, listComments))
+	http.HandleFunc("/moderate", authorize(permModerate, moderate))
+	http.HandleFunc("/reindex", authorize(permModerate, reindex))
+	http.HandleFunc("/upload", authorize(permUpload, upload))
+	http.HandleFunc("/medialist", authorize(permRead, listMedia))
+	http.HandleFunc("/tokens", authorize(permManage, tokens))
+	http.HandleFunc("/authors", authorize(permManage, authors))
+	http.HandleFunc("/import", authorize(permManage, importPosts))
+	http.HandleFunc("/export", authorize(permManage, exportPosts))
+	http.HandleFunc("/admin/backup", authorize(permManage, backup))
+	http.HandleFunc("/admin/restore", authorize(permManage, restore))
+	http.HandleFunc("/accounts", authorize(permRead, accounts))
+	http.HandleFunc("/session", currentSession)
+
+	// Logging in and out, for the blog's own accounts (see localauth.go)
+	http.HandleFunc("/login", login)
+	http.HandleFunc("/logout", logout)
+
+	// Reader comments
+	http.HandleFunc("/comment", postComment)
+	http.HandleFunc("/webmention", webmention)
+
+	// JSON API; authorization is checked per method in api.go
+	http.HandleFunc("/api/v1/", api)
 
 	// oauth
 //	http.HandleFunc("/oauth2callback", callback)
 
 	// Normal blog viewing
-	http.HandleFunc("/atom.xml", feed)
+	http.HandleFunc("/atom.xml", atomFeed.serve)
+	http.HandleFunc("/rss.xml", rssFeed.serve)
+	http.HandleFunc("/feed.json", jsonFeed.serve)
+	http.HandleFunc("/xmlrpc", xmlrpc) // Authenticates with API tokens itself
+	http.HandleFunc("/rsd.xml", rsd)
+	http.HandleFunc("/sitemap.xml", sitemap)
+	http.HandleFunc("/robots.txt", robots)
+	http.HandleFunc("/micropub", micropub) // Also authenticates with API tokens
+	http.HandleFunc("/micropub/media", micropubMedia)
+	http.HandleFunc("/atompub", atompub) // So does AtomPub
+	http.HandleFunc("/atompub/", atompub)
+	http.HandleFunc("/search", search)
+	http.HandleFunc("/media/", serveMedia)
 	http.HandleFunc("/", view)
 }
 
-func writePost(w io.Writer, b Blog) error {
-	var fmap = template.FuncMap{
-		"markdown": markdown,
+// funcMap returns the functions available to blog templates
+func funcMap(admin bool, embeds []embed, c appengine.Context) template.FuncMap {
+	return template.FuncMap{
+		"markdown": func(lead, content string) string { return markdown(lead, content, embeds) },
+		"archives": func() ([]ArchiveYear, error) { return archives(admin, c) },
+		"tagpath":  tagPath,
+		"authorpath": authorPath,
+		"metadata": func(b Blog) (string, error) { return metadata(b, c) },
 	}
-	viewTemplate := template.Must(template.New("view").Funcs(fmap).Parse(b.Template))
+}
+
+func writePost(w io.Writer, b Blog, c appengine.Context) error {
+	viewTemplate := template.Must(template.New("view").Funcs(funcMap(b.Admin, blogEmbeds(b.Embeds), c)).Parse(b.Template))
 
 	if err := viewTemplate.Execute(w, b); err != nil {
 		return err
@@ -75,6 +139,14 @@ func writePost(w io.Writer, b Blog) error {
 // displays as a blog entry, without interacting with memcache or the datastore
 func preview(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
+
+	// The preview shows whatever it's sent, so other sites mustn't be able to
+	// link to one. Only POSTs are checked for the CSRF token.
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	b, err := getBlogInfo(c)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -89,7 +161,7 @@ func preview(w http.ResponseWriter, r *http.Request) {
 		Content: r.FormValue("Content"),
 	}
 
-	if err := writePost(w, b); err != nil {
+	if err := writePost(w, b, c); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
@@ -101,20 +173,25 @@ func view(w http.ResponseWriter, r *http.Request) {
 	// Trim leading slash and possible trailing slash from path
 	path := strings.TrimSuffix(r.URL.Path[1:], "/")
 
+	// Old "?p=123" style links to imported posts. Cached pages are keyed by
+	// path alone, so these are looked up first.
+	if r.URL.RawQuery != "" && redirect(w, r, c) {
+		return
+	}
+
 	// Non-admins should get raw HTML from memcache if possible, and avoid
 	// touching the datastore at all.
-	if ! user.IsAdmin(c) {
-		item, err := memcache.Get(c, "post." + path)
+	admin := isAdmin(c, r)
+	if ! admin {
+		page, err := getCachedPage(c, "post." + path)
 		if err == nil {
-			w.Write(item.Value)
+			page.write(w, r)
 			return
 		}
 	}
 
 	b, err := getBlogInfo(c)
-	if user.IsAdmin(c) {
-		b.Admin = true
-	}
+	b.Admin = admin
 
 	if err != nil {
 		if err == datastore.ErrNoSuchEntity {
@@ -126,48 +203,109 @@ func view(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	start, end, period, isArchive := archivePeriod(path)
+
 	if r.URL.Path == "/" {
 		// Get Leads for recent posts
-		// TODO: Play with r.URL.RawQuery for custom searches
-		p, err := getRecentPosts(c)
+		p, err := getRecentPosts(b.Admin, c)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		b.Posts = p
-	} else {
-		b.Posts = make([]Post, 1)
-		b.Single = true
-		p, err := getPost(path, c)
-		b.Posts[0] = p
+	} else if strings.HasPrefix(path, tagPrefix) {
+		b.Archive = true
+		b.Tag = strings.TrimPrefix(path, tagPrefix)
+		b.Posts, err = getTagPosts(b.Tag, b.Admin, c)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+	} else if strings.HasPrefix(path, authorPrefix) {
+		a, err := getAuthor(c, strings.TrimPrefix(path, authorPrefix))
+		if err == datastore.ErrNoSuchEntity {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b.Archive = true
+		b.Profile = &a
+		b.Posts, err = getAuthorPosts(a.ID, b.Admin, c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if path == "archive" {
+		// The archive index lists months via the "archives" template function
+		b.Archive = true
+	} else {
+		p, err := getPost(path, b.Admin, c)
+
+		// "YYYY/MM" is always a month, but "YYYY" is only a year if no post
+		// happens to have that numeric ID
+		if isArchive && (strings.Contains(path, "/") || err == datastore.ErrNoSuchEntity) {
+			b.Archive = true
+			b.Period = period
+			b.Posts, err = getArchivePosts(start, end, b.Admin, c)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			// Unknown paths may be the old permalinks of imported posts
+			if (err == nil && p.ID == 0 || err == datastore.ErrNoSuchEntity) && redirect(w, r, c) {
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if p.CommentCount > 0 {
+				p.Comments, err = getComments(p.ID, c)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			p.Mentions, err = getMentions(p.ID, c)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := getPostAuthor(c, &p); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			b.Single = true
+			b.Posts = []Post{p}
+		}
 	}
 
 	// Admin users shouldn't write to memcache, as they can see hidden items.
-	if user.IsAdmin(c) {
-		if err := writePost(w, b); err != nil {
+	if admin {
+		w.Header().Set("Cache-Control", privateCacheControl)
+		if err := writePost(w, b, c); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 		return
 	}
 
 	var buffer bytes.Buffer
-	if err := writePost(&buffer, b); err != nil {
+	if err := writePost(&buffer, b, c); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	item := &memcache.Item {
-	   Key: "post." + path,
-	   Value: buffer.Bytes(),
-	}
-	memcache.Set(c, item)
-	w.Write(item.Value)
+	// Edits, deletions and template changes don't date any post, so the
+	// page's Last-Modified is when it was rendered, as with feeds
+	page := newCachedPage(buffer.Bytes(), "text/html; charset=utf-8", time.Now(), cacheControl(b, r.URL.Path))
+	page.cache(c, "post." + path)
+	page.write(w, r)
 }
 
-func getPost(path string, c appengine.Context) (Post, error) {
+func getPost(path string, admin bool, c appengine.Context) (Post, error) {
 	var id int64
 	var err error
 	p := Post{}
@@ -186,12 +324,13 @@ func getPost(path string, c appengine.Context) (Post, error) {
 		if err := datastore.Get(c, k, &p); err != nil {
 			return p, err
 		}
+		p.ID = id
 	} else {
 		p.Title = "Page not found"
 		return p, nil
 	}
 
-	if ! user.IsAdmin(c) && p.Hidden {
+	if ! admin && p.Hidden {
 		return Post{ Title: "This page is currently unavailable" }, nil
 	}
 
@@ -225,16 +364,16 @@ func getBlogInfo(c appengine.Context) (Blog, error) {
 	return b, nil
 }
 
-func getRecentPosts(c appengine.Context) ([]Post, error) {
-	p, err := getPosts(10, 0, true, c)
+func getRecentPosts(admin bool, c appengine.Context) ([]Post, error) {
+	p, err := getPosts(10, 0, true, admin, c)
 	return p, err
 }
 
-func getPosts(num, start int, details bool, c appengine.Context) ([]Post, error) {
+func getPosts(num, start int, details, admin bool, c appengine.Context) ([]Post, error) {
 	p := make([]Post, 0, num)
 	q := datastore.NewQuery("Post").Order("-Date").Limit(num)
 
-	if ! user.IsAdmin(c) {
+	if ! admin {
 		q = q.Filter("Hidden =", false);
 	}
 
@@ -259,6 +398,11 @@ func getPosts(num, start int, details bool, c appengine.Context) ([]Post, error)
 
 // AJAX functions
 func flush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	err := memcache.Flush(appengine.NewContext(r))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -269,7 +413,7 @@ func flush(w http.ResponseWriter, r *http.Request) {
 
 func list(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
-	p, err := getRecentPosts(c)
+	p, err := getRecentPosts(isAdmin(c, r), c)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -303,7 +447,8 @@ func info(w http.ResponseWriter, r *http.Request) {
 }
 
 func load(w http.ResponseWriter, r *http.Request) {
-	p, err := getPost(r.FormValue("id"), appengine.NewContext(r))
+	c := appengine.NewContext(r)
+	p, err := getPost(r.FormValue("id"), isAdmin(c, r), c)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -320,28 +465,19 @@ func load(w http.ResponseWriter, r *http.Request) {
 
 func post(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 	p := Post{
 		Title:       r.FormValue("Title"),
 		Description: r.FormValue("Description"),
 		Date:        time.Now(),
 	}
 
-	content := r.FormValue("Content")
-	re := regexp.MustCompile( `(.*\n){5}` )
-	five := re.FindStringIndex(content)
-	
-	var i int
-	switch {
-	case five != nil && five[1] < 500:
-		i = five[1]
-	case len(content) < 500:
-		i = len(content)
-	default:
-		i = 500
-	}
-
-	p.Lead = content[0:i]
-	p.Content = content[i:]
+	p.Lead, p.Content = splitLead(r.FormValue("Content"))
+	p.Tags = splitTags(r.FormValue("Tags"))
 
 	if r.FormValue("Hidden") == "" {
 		p.Hidden = false
@@ -360,12 +496,9 @@ func post(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if err := memcache.Flush(c); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
+	cl := requestCaller(c, r)
 	k := new(datastore.Key)
+	var old *Post
 	if r.FormValue("id") == "" {
 		k = datastore.NewIncompleteKey(c, "Post", nil)
 	} else {
@@ -375,10 +508,27 @@ func post(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		k = datastore.NewKey(c, "Post", "", id, nil)
+
+		o := Post{}
+		if err := datastore.Get(c, k, &o); err == nil {
+			old = &o
+		} else if err != datastore.ErrNoSuchEntity {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 
-	_, err := datastore.Put(c, k, &p)
-	if err != nil {
+	// New posts, including those given an unused id, belong to their writer
+	if old == nil {
+		p.AuthorID = cl.AuthorID
+	}
+
+	if err := cl.canSave(old, &p); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if _, err := savePost(c, k, &p); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -386,11 +536,97 @@ func post(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "success")
 }
 
-func verifyTemplate(w http.ResponseWriter, r *http.Request) {
-	var fmap = template.FuncMap{
-		"markdown": markdown,
+// splitLead divides post content into the lead shown on the front page, the
+// first five lines or 500 bytes, whichever is shorter, and the remainder.
+func splitLead(content string) (string, string) {
+	re := regexp.MustCompile( `(.*\n){5}` )
+	five := re.FindStringIndex(content)
+
+	var i int
+	switch {
+	case five != nil && five[1] < 500:
+		i = five[1]
+	case len(content) < 500:
+		i = len(content)
+	default:
+		i = 500
+	}
+
+	return content[0:i], content[i:]
+}
+
+// splitTags parses a comma separated tag list
+func splitTags(s string) []string {
+	return cleanTags(strings.Split(s, ","))
+}
+
+// cleanTags trims tags, dropping blank and repeated ones
+func cleanTags(tags []string) []string {
+	t := make([]string, 0, len(tags))
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		seen[strings.ToLower(tag)] = true
+		t = append(t, tag)
+	}
+	return t
+}
+
+// savePost writes a post to the datastore and the search index, and flushes
+// memcache so cached pages and feeds pick up the change. An incomplete key
+// creates a new post; the completed key is returned.
+func savePost(c appengine.Context, k *datastore.Key, p *Post) (*datastore.Key, error) {
+	if err := memcache.Flush(c); err != nil {
+		return k, err
 	}
 
+	// Approved comment counts are maintained by moderate(), not the editor,
+	// slugs only come from imports, and authors are set when posts are created
+	if !k.Incomplete() {
+		old := Post{}
+		if err := datastore.Get(c, k, &old); err == nil {
+			p.CommentCount = old.CommentCount
+			if p.Slug == "" {
+				p.Slug = old.Slug
+			}
+			if p.AuthorID == "" {
+				p.AuthorID = old.AuthorID
+			}
+			// Moving a post takes it out of its old month's archive
+			if !old.Date.Equal(p.Date) {
+				defer expireArchive(c, old.Date)
+			}
+		}
+	}
+
+	p.Updated = time.Now()
+	k, err := datastore.Put(c, k, p)
+	if err != nil {
+		return k, err
+	}
+
+	return k, postSaved(c, k.IntID(), p)
+}
+
+// postSaved updates whatever is derived from a post once it's been written:
+// the feeds and archive, the search index, and for visible posts, Webmention
+// targets and WebSub hubs
+func postSaved(c appengine.Context, id int64, p *Post) error {
+	expireFeed(c)
+	expireArchive(c, p.Date)
+	if !p.Hidden {
+		sendMentions.Call(c, id)
+		notifyHubs(c)
+	}
+	return indexPost(c, id, p)
+}
+
+func verifyTemplate(w http.ResponseWriter, r *http.Request) {
+	fmap := funcMap(false, nil, appengine.NewContext(r))
+
 	_, err := template.New("config").Funcs(fmap).Parse( r.FormValue("Template") )
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -401,7 +637,11 @@ func verifyTemplate(w http.ResponseWriter, r *http.Request) {
 
 func deletePost(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
-	memcache.Flush(c)
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
 	id, err := strconv.ParseInt(r.FormValue("ID"), 10, 64)
 	if err != nil {
@@ -409,18 +649,56 @@ func deletePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	k := datastore.NewKey(c, "Post", "", id, nil)
-	if err := datastore.Delete(c, k); err != nil {
+	p := Post{}
+	if err := datastore.Get(c, datastore.NewKey(c, "Post", "", id, nil), &p); err != nil && err != datastore.ErrNoSuchEntity {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := requestCaller(c, r).canDelete(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	memcache.Flush(c)
+	if err := removePost(c, id); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	fmt.Fprint(w, "success")
 }
 
-func config(w http.ResponseWriter, r *http.Request) {
-	// First, define the default template. If this is a naked call to "/init",
-	// or if the form field "Template" is blank, this template will be used
-	const defaultViewTemplateHTML = `<!DOCTYPE html>
+// removePost deletes a post along with its comments, mentions and search
+// index entry
+func removePost(c appengine.Context, id int64) error {
+	k := datastore.NewKey(c, "Post", "", id, nil)
+	p := Post{}
+	if err := datastore.Get(c, k, &p); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	// A kindless query finds every child entity
+	q := datastore.NewQuery("").Ancestor(k).KeysOnly()
+	keys, err := q.GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	if err := datastore.DeleteMulti(c, keys); err != nil {
+		return err
+	}
+
+	if err := datastore.Delete(c, k); err != nil {
+		return err
+	}
+
+	expireFeed(c)
+	expireArchive(c, p.Date)
+	notifyHubs(c)
+	return unindexPost(c, id)
+}
+
+// The default template. If this is a naked call to "/init", or if the form
+// field "Template" is blank, this template will be used
+const defaultViewTemplateHTML = `<!DOCTYPE html>
 <html lang="en">
 <head>
 	<meta charset="utf-8">
@@ -431,10 +709,22 @@ func config(w http.ResponseWriter, r *http.Request) {
 	{{ else }}
 		<title>{{.Title}}</title>
 		<meta name="description" content="{{.Description}}">
-		<link rel="alternate" type="application/atom+xml" title="{{.Title}}" href="atom.xml" />
+		<link rel="alternate" type="application/atom+xml" title="{{.Title}}" href="/atom.xml" />
+		<link rel="alternate" type="application/rss+xml" title="{{.Title}}" href="/rss.xml" />
+		<link rel="alternate" type="application/feed+json" title="{{.Title}}" href="/feed.json" />
 	{{ end }}
+	{{ if .Profile }}
+		<link rel="alternate" type="application/atom+xml" title="{{html .Profile.Name}}" href="/atom.xml?author={{urlquery .Profile.ID}}" />
+		<link rel="alternate" type="application/rss+xml" title="{{html .Profile.Name}}" href="/rss.xml?author={{urlquery .Profile.ID}}" />
+		<link rel="alternate" type="application/feed+json" title="{{html .Profile.Name}}" href="/feed.json?author={{urlquery .Profile.ID}}" />
+	{{ end }}
+	{{metadata .}}
 	<meta name="viewport" content="width=device-width, initial-scale=1.0">
 	<meta name="author" content="{{.Author}}">
+	<link rel="EditURI" type="application/rsd+xml" title="RSD" href="/rsd.xml" />
+	<link rel="micropub" href="/micropub" />
+	<link rel="service" type="application/atomsvc+xml" href="/atompub" />
+	<link rel="webmention" href="/webmention" />
 
 	<link href="/static/bootstrap/css/bootstrap.min.css" rel="stylesheet">
 
@@ -470,6 +760,30 @@ func config(w http.ResponseWriter, r *http.Request) {
 		img {
 			margin-bottom: 5px;
 		}
+
+		figure.embed {
+			margin: 10px 0;
+		}
+
+		figure.embed img {
+			max-width: 100%;
+			height: auto;
+		}
+
+		figure.embed-youtube, figure.embed-vimeo, figure.embed-flickr {
+			position: relative;
+			padding-bottom: 56.25%;
+			height: 0;
+			overflow: hidden;
+		}
+
+		figure.embed iframe {
+			position: absolute;
+			top: 0;
+			left: 0;
+			width: 100%;
+			height: 100%;
+		}
 	</style>
 
 	<script type="text/javascript">
@@ -481,6 +795,20 @@ func config(w http.ResponseWriter, r *http.Request) {
 		function add_entry( title, key ) {
 			var html = '<li><a href="/' + key + '">' + title + '</a></li>';
 			$( '#entries' ).append( html );
+		}
+
+		function postComment() {
+			$.ajax({
+				url: '/comment',
+				type: 'POST',
+				data: $('#commentForm').serialize(),
+				success: function() {
+					$('#commentForm').replaceWith('<p class="text-muted">Thanks! Your comment is awaiting moderation.</p>');
+				},
+				error: function( xhr, ajaxOptions, thrownError ) {
+					alert( xhr.responseText );
+				}
+			});
 		}
 
 		function init() {
@@ -528,7 +856,28 @@ func config(w http.ResponseWriter, r *http.Request) {
 							<li class="muted"><a href="javascript:blur()">loading...</a></li>
 						</ul>
 					</li>
+					<li class="dropdown">
+						<a href="#" class="dropdown-toggle" data-toggle="dropdown">
+							Archives
+							<b class="caret"></b>
+						</a>
+						<ul class="dropdown-menu">
+							{{range archives}}
+								<li class="dropdown-header"><a href="{{.Path}}">{{.Year}} ({{.Count}})</a></li>
+								{{range .Months}}
+									<li><a href="{{.Path}}">{{.Month}} ({{.Count}})</a></li>
+								{{end}}
+							{{end}}
+							<li class="divider"></li>
+							<li><a href="/archive">All archives</a></li>
+						</ul>
+					</li>
 				</ul>
+				<form class="navbar-form navbar-left" role="search" action="/search">
+					<div class="form-group">
+						<input type="text" class="form-control" name="q" placeholder="Search" value="{{html .Query}}">
+					</div>
+				</form>
 				<ul class="nav navbar-nav navbar-right">
 					<li id="About"><a href="/1">About</a></li>
 					{{if .Admin}}
@@ -544,19 +893,117 @@ func config(w http.ResponseWriter, r *http.Request) {
 			<h1 class="text-center jumbotron">{{.Title}}</h1>
 		</div>
 
+		{{if .Search}}
+			<h3 class="text-center">Search results{{if .Query}} for &ldquo;{{html .Query}}&rdquo;{{end}}</h3>
+			{{range .Posts}}
+				<h4><a href="/{{.ID}}">{{.Title}}</a></h4>
+				<p class="text-muted">{{.Date.Format "Monday, January 02, 2006"}}</p>
+				<p>{{.Snippet}}</p>
+			{{else}}
+				<p class="text-center">No posts found.</p>
+			{{end}}
+			<hr />
+		{{else if .Archive}}
+			{{if or .Period .Tag .Profile}}
+				{{if .Profile}}
+					<h3 class="text-center">Posts by {{html .Profile.Name}}</h3>
+					<div class="media">
+						{{if .Profile.Avatar}}
+							<img class="media-object pull-left img-circle" src="{{html .Profile.Avatar}}" alt="" width=64 height=64>
+						{{end}}
+						<div class="media-body">{{html .Profile.Bio}}</div>
+					</div>
+				{{else if .Tag}}
+					<h3 class="text-center">Posts tagged &ldquo;{{html .Tag}}&rdquo;</h3>
+				{{else}}
+					<h3 class="text-center">Posts from {{.Period}}</h3>
+				{{end}}
+				<ul class="list-unstyled">
+				{{range .Posts}}
+					<li>
+						<span class="text-muted">{{.Date.Format "January 02, 2006"}}</span>
+						&mdash; <a href="/{{.ID}}">{{.Title}}</a>
+					</li>
+				{{else}}
+					<li>No posts found.</li>
+				{{end}}
+				</ul>
+			{{else}}
+				<h3 class="text-center">Archives</h3>
+				{{range archives}}
+					<h4><a href="{{.Path}}">{{.Year}}</a></h4>
+					<ul>
+					{{range .Months}}
+						<li><a href="{{.Path}}">{{.Month}}</a> ({{.Count}})</li>
+					{{end}}
+					</ul>
+				{{end}}
+			{{end}}
+			<hr />
+		{{else}}
 		{{range .Posts}}
 			<h3 class="text-center">
-				{{if .ID}}
+				{{if and .ID (not $.Single)}}
 					<a href="/{{.ID}}">{{.Title}}</a>
 				{{else}}
 					{{.Title}}
 				{{end}}
 			</h3>
-			<h4>{{.Date.Format "Monday, January 02, 2006"}}</h4>
+			<h4>{{.Date.Format "Monday, January 02, 2006"}}{{if and $.Single .Author}}
+				by <a href="{{html (authorpath .Author.ID)}}">{{html .Author.Name}}</a>{{end}}</h4>
 			<div id="body">
 				{{markdown .Lead .Content}}
 			</div>
+			{{if and $.Single .Tags}}
+				<p class="text-muted">
+					Tagged {{range $i, $t := .Tags}}{{if $i}}, {{end}}<a href="{{html (tagpath $t)}}">{{html $t}}</a>{{end}}
+				</p>
+			{{end}}
 			<hr />
+			{{if and $.Single .ID}}
+				<div id="comments">
+					<h4>{{.CommentCount}} comment{{if ne .CommentCount 1}}s{{end}}</h4>
+					{{range .Comments}}
+						<blockquote>
+							<p>{{html .Content}}</p>
+							<small>
+								{{if .URL}}<a href="{{html .URL}}" rel="nofollow">{{html .Author}}</a>{{else}}{{html .Author}}{{end}},
+								{{.Date.Format "January 02, 2006"}}
+							</small>
+						</blockquote>
+					{{end}}
+					<form id="commentForm" role="form" action="javascript:postComment()">
+						<input type="hidden" name="PostID" value="{{.ID}}">
+						<input type="text" name="Subject" style="display:none" tabindex="-1" autocomplete="off">
+						<div class="form-group">
+							<input type="text" class="form-control" name="Author" placeholder="Name" required>
+						</div>
+						<div class="form-group">
+							<input type="email" class="form-control" name="Email" placeholder="Email (not published)">
+						</div>
+						<div class="form-group">
+							<input type="text" class="form-control" name="URL" placeholder="Website">
+						</div>
+						<div class="form-group">
+							<textarea class="form-control" name="Content" rows=5 required></textarea>
+						</div>
+						<button type="submit" class="btn btn-default">Leave a comment</button>
+					</form>
+				</div>
+				<hr />
+				{{if .Mentions}}
+					<div id="mentions">
+						<h4>Mentioned by</h4>
+						<ul>
+						{{range .Mentions}}
+							<li><a href="{{html .Source}}" rel="nofollow">{{if .Title}}{{html .Title}}{{else}}{{html .Source}}{{end}}</a></li>
+						{{end}}
+						</ul>
+					</div>
+					<hr />
+				{{end}}
+			{{end}}
+		{{end}}
 		{{end}}
 
 	</div>
@@ -565,6 +1012,13 @@ func config(w http.ResponseWriter, r *http.Request) {
 </body>
 </html>
 `
+
+func config(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	c   := appengine.NewContext(r)
 	k   := datastore.NewKey(c, "Blog", "singleton", 0, nil)
 	b   := Blog{}
@@ -586,11 +1040,47 @@ func config(w http.ResponseWriter, r *http.Request) {
 			b.Template = r.FormValue("Template")
 		}
 
-		_, err := datastore.Put(c, k, &b)
+		// Embed providers are edited as JSON; blank selects the defaults
+		if e := strings.TrimSpace(r.FormValue("Embeds")); e != "" {
+			if err := json.Unmarshal([]byte(e), &b.Embeds); err != nil {
+				http.Error(w, "Embed providers: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, err := compileEmbeds(b.Embeds); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// WebSub hubs, one per line
+		hubs, err := parseHubs(r.FormValue("Hubs"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b.Hubs = hubs
+
+		// The canonical address used in feeds; blank means the app's own
+		if b.BaseURL, err = parseBaseURL(r.FormValue("BaseURL")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Cache-Control by path, one rule per line; blank selects the defaults
+		if b.CacheControl, err = parseCacheRules(r.FormValue("CacheControl")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = datastore.Put(c, k, &b)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+
+		// The feed carries the blog's title, author and hubs
+		expireFeed(c)
+		expireArchives(c)
 		fmt.Fprint(w, "success")
 		return
 	}
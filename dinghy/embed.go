@@ -0,0 +1,145 @@
+package dinghy
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sync"
+	"text/template"
+)
+
+// An EmbedProvider expands a link that sits alone on its own line into
+// embedded markup, such as a video player or a responsive image. Pattern is a
+// regular expression matched against the whole link, and Template is a
+// text/template executed with the link's URL, and Match, the pattern's
+// submatches. Expansion is purely textual; nothing is fetched at render time.
+type EmbedProvider struct {
+	Name     string
+	Pattern  string
+	Template string
+}
+
+// Providers used when the blog settings don't configure any
+var defaultEmbedProviders = []EmbedProvider{
+	{
+		Name:     "youtube",
+		Pattern:  `^https?://(?:www\.)?(?:youtu\.be/|youtube\.com/watch\?v=)([\w-]{11})(?:[?&]\S*)?$`,
+		Template: `<iframe src="https://www.youtube.com/embed/{{index .Match 1}}" frameborder="0" allowfullscreen></iframe>`,
+	},
+	{
+		Name:     "vimeo",
+		Pattern:  `^https?://(?:www\.)?vimeo\.com/(\d+)$`,
+		Template: `<iframe src="https://player.vimeo.com/video/{{index .Match 1}}" frameborder="0" allowfullscreen></iframe>`,
+	},
+	{
+		Name:     "flickr",
+		Pattern:  `^https?://(?:www\.)?flickr\.com/photos/([\w@-]+)/(\d+)/?$`,
+		Template: `<iframe src="https://www.flickr.com/photos/{{index .Match 1}}/{{index .Match 2}}/player/" frameborder="0" allowfullscreen></iframe>`,
+	},
+	{
+		// Picasa Web Albums images now live on googleusercontent.com
+		Name:     "googlephotos",
+		Pattern:  `^https://lh\d\.(?:googleusercontent|ggpht)\.com/[\w/=-]+$`,
+		Template: `<a href="{{.URL}}"><img src="{{.URL}}" alt="" /></a>`,
+	},
+	{
+		Name:     "image",
+		Pattern:  `(?i)^https?://\S+\.(?:jpe?g|png|gif)$`,
+		Template: `<img src="{{.URL}}" alt="" />`,
+	},
+}
+
+type embed struct {
+	name string
+	re   *regexp.Regexp
+	tmpl *template.Template
+}
+
+// Bare links on a line of their own, optionally in angle brackets
+var embedLineRe = regexp.MustCompile(`(?m)^ {0,3}<?(https?://\S+?)>? *$`)
+
+var defaultEmbeds = mustCompileEmbeds(defaultEmbedProviders)
+
+// The providers from the blog settings last seen, compiled, as they rarely
+// change. Compiled providers are safe to share between requests.
+var embedCache struct {
+	sync.Mutex
+	providers []EmbedProvider
+	embeds    []embed
+}
+
+// compileEmbeds checks and compiles a provider list, as configured in the blog
+// settings.
+func compileEmbeds(providers []EmbedProvider) ([]embed, error) {
+	e := make([]embed, 0, len(providers))
+	for _, p := range providers {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("embed provider %q: %v", p.Name, err)
+		}
+		t, err := template.New(p.Name).Parse(p.Template)
+		if err != nil {
+			return nil, fmt.Errorf("embed provider %q: %v", p.Name, err)
+		}
+		e = append(e, embed{name: p.Name, re: re, tmpl: t})
+	}
+	return e, nil
+}
+
+func mustCompileEmbeds(providers []EmbedProvider) []embed {
+	e, err := compileEmbeds(providers)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// blogEmbeds returns the compiled providers for the blog settings' list, for
+// markdown(). An empty list selects the defaults. Invalid providers are
+// rejected when blog settings are saved, so here they just select the
+// defaults too.
+func blogEmbeds(providers []EmbedProvider) []embed {
+	if len(providers) == 0 {
+		return defaultEmbeds
+	}
+
+	embedCache.Lock()
+	defer embedCache.Unlock()
+	if !reflect.DeepEqual(providers, embedCache.providers) {
+		e, err := compileEmbeds(providers)
+		if err != nil {
+			return defaultEmbeds
+		}
+		embedCache.providers = append([]EmbedProvider(nil), providers...)
+		embedCache.embeds = e
+	}
+	return embedCache.embeds
+}
+
+// doEmbeds replaces lines consisting of a single link recognized by a provider
+// with a <figure>, hashed so that it isn't wrapped in paragraph tags.
+func doEmbeds(s string, embeds []embed) string {
+	return embedLineRe.ReplaceAllStringFunc(s, func(line string) string {
+		url := embedLineRe.FindStringSubmatch(line)[1]
+		for _, e := range embeds {
+			m := e.re.FindStringSubmatch(url)
+			if m == nil {
+				continue
+			}
+
+			var buffer bytes.Buffer
+			buffer.WriteString(`<figure class="embed embed-` + e.name + `">`)
+			err := e.tmpl.Execute(&buffer, struct {
+				URL   string
+				Match []string
+			}{url, m})
+			if err != nil {
+				return line
+			}
+			buffer.WriteString("</figure>")
+			return blockToMD5(buffer.String())
+		}
+		return line
+	})
+}
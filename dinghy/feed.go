@@ -0,0 +1,352 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ *  Feeds of the most recent 10 posts, in Atom, RSS 2.0 and JSON Feed 1.1,
+ *  with older posts in pages and monthly archives (see feedarchive.go).
+ *  Each document is rendered from the same format-neutral feedData, and
+ *  cached the same way: in memcache first, then in a Feed datastore entity,
+ *  before generating one from scratch. The latter is very expensive, as it
+ *  results in multiple calls to the datastore to query each post, and to
+ *  convert the content markdown to escaped HTML.
+ */
+
+// RawFeed is a rendered feed, in whichever format. The field is named XML
+// for the Atom feeds stored before there were others.
+type RawFeed struct {
+	XML  []byte    `datastore:",noindex"`
+	Date time.Time `datastore:",noindex"`
+}
+
+// A feedFormat describes one of the feeds
+type feedFormat struct {
+	path        string
+	contentType string
+	// memcache key, and Feed entity key name
+	cacheKey string
+	keyName  string
+	// XML feeds are stored without their XML declaration
+	xml bool
+	// render is given the address of the feed's subscription document
+	render func(f *feedData, feed string) ([]byte, error)
+}
+
+var (
+	atomFeed = &feedFormat{"/atom.xml", "application/atom+xml", "feed.atom", "singleton", true, renderAtom}
+	rssFeed  = &feedFormat{"/rss.xml", "application/rss+xml", "feed.rss", "rss", true, renderRSS}
+	jsonFeed = &feedFormat{"/feed.json", "application/feed+json", "feed.json", "json", false, renderJSONFeed}
+
+	feedFormats = []*feedFormat{atomFeed, rssFeed, jsonFeed}
+)
+
+// feedData is a feed before rendering in a particular format
+type feedData struct {
+	Title       string
+	Description string
+	Author      string
+	// Atom ID of the blog, which entry IDs extend
+	ID      string
+	Home    string
+	Base    string
+	Hubs    []string
+	Updated time.Time
+	Items   []feedItem
+
+	// Which document this is, and its neighbours (RFC 5005)
+	Doc         feedDoc
+	Pages       int
+	PrevArchive time.Time
+	NextArchive time.Time
+}
+
+type feedItem struct {
+	ID        string
+	URL       string
+	Title     string
+	Summary   string
+	HTML      string
+	Tags      []string
+	Published time.Time
+	Updated   time.Time
+	// The post's author, or the feed's, with their page and picture if
+	// they're one of the blog's authors
+	Author    string
+	AuthorURL string
+	Avatar    string
+}
+
+// url returns the feed's address on a blog
+func (ff *feedFormat) url(base string) string {
+	return base + ff.path
+}
+
+// cacheName is the memcache key, and Feed entity key name, of a document
+func (ff *feedFormat) cacheName(d feedDoc, entity bool) string {
+	switch {
+	case d.name() != "":
+		return ff.cacheKey + "." + d.name()
+	case entity:
+		return ff.keyName
+	}
+	return ff.cacheKey
+}
+
+func (ff *feedFormat) key(c appengine.Context, d feedDoc) *datastore.Key {
+	return datastore.NewKey(c, "Feed", ff.cacheName(d, true), 0, nil)
+}
+
+// serve is the feed's handler
+func (ff *feedFormat) serve(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	raw := RawFeed{}
+	now := time.Now()
+
+	d, ok := parseFeedDoc(r.URL.Query())
+	if !ok {
+		http.Error(w, "Invalid page or archive", http.StatusBadRequest)
+		return
+	}
+
+	// If feed is in memcache, return it directly (new posts flush memcache)
+	page, err := getCachedPage(c, ff.cacheName(d, false))
+	if err == nil {
+		page.write(w, r)
+		return
+	}
+
+	b, err := getBlogInfo(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// If feed is in datastore and date >= most recent post date, return
+	// datastore feed. Archives are expired when their posts change, so are
+	// always current.
+	l, err := lastPostDate(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = datastore.Get(c, ff.key(c, d), &raw)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err == nil && (raw.Date.After(l) || d.isArchive()) {
+		page = ff.page(b, raw)
+		page.cache(c, ff.cacheName(d, false))
+		page.write(w, r)
+		return
+	}
+
+	// Otherwise, generate feed from posts, write to datastore, memcache, and response writer
+	f, err := buildFeed(c, now, d)
+	if err == errNoFeedDoc {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	output, err := ff.render(&f, ff.url(f.Base))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// If we can't write to the datastore, stop. This will prevent clients from
+	// seeing updates with the same contents but different timestamps, which
+	// may cause duplicate updates in readers.
+	raw.XML = output
+	raw.Date = now
+	if _, err := datastore.Put(c, ff.key(c, d), &raw); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// ...and to memcache
+	page = ff.page(b, raw)
+	page.cache(c, ff.cacheName(d, false))
+
+	// ...and to HTTP caller
+	page.write(w, r)
+}
+
+// page prepares a stored document for serving. Its Last-Modified is when it
+// was generated, as settings changes regenerate feeds without dating a post.
+func (ff *feedFormat) page(b Blog, raw RawFeed) *cachedPage {
+	body := raw.XML
+	if ff.xml {
+		body = append([]byte(xml.Header), raw.XML...)
+	}
+	return newCachedPage(body, ff.contentType, raw.Date, cacheControl(b, ff.path))
+}
+
+// buildFeed collects the blog's details and a document's posts for rendering
+func buildFeed(c appengine.Context, now time.Time, d feedDoc) (feedData, error) {
+	b, err := getBlogInfo(c)
+	if err != nil {
+		return feedData{}, err
+	}
+	base := siteURL(b, c)
+
+	// Atom requires a non-empty author name, and every entry has this one
+	f := feedData{
+		Title:       b.Title,
+		Description: b.Description,
+		Author:      b.Author,
+		ID:          feedID(appengine.DefaultVersionHostname(c)),
+		Home:        base + "/",
+		Base:        base,
+		Hubs:        b.Hubs,
+		Updated:     now,
+		Items:       make([]feedItem, 0),
+		Doc:         d,
+	}
+	if f.Author == "" {
+		f.Author = b.Title
+	}
+
+	// The feed is cached and shared, so it never includes hidden posts. An
+	// author's feed has its own ID, but its entries keep theirs.
+	blogID := f.ID
+	keys, err := feedPosts(c, &f)
+	if err != nil {
+		return f, err
+	}
+
+	embeds := blogEmbeds(b.Embeds)
+	var latest time.Time
+	profiles := make(map[string]*AuthorProfile)
+	for _, k := range keys {
+		idStr := strconv.FormatInt(k.IntID(), 10)
+		post, err := getPost(idStr, false, c)
+		if err == datastore.ErrNoSuchEntity {
+			// Deleted since the query ran
+			continue
+		} else if err != nil {
+			return f, err
+		}
+
+		updated := post.Updated
+		if updated.Before(post.Date) {
+			updated = post.Date
+		}
+		if updated.After(latest) {
+			latest = updated
+		}
+
+		item := feedItem{
+			ID:        blogID + ".post-" + idStr,
+			URL:       base + "/" + idStr,
+			Title:     post.Title,
+			Summary:   post.Description,
+			HTML:      markdown(post.Lead, post.Content, embeds),
+			Tags:      post.Tags,
+			Published: post.Date,
+			Updated:   updated,
+			Author:    f.Author,
+		}
+
+		// Most posts are by a few authors, so each is read once
+		a, seen := profiles[post.AuthorID]
+		if !seen && post.AuthorID != "" {
+			if err := getPostAuthor(c, &post); err != nil {
+				return f, err
+			}
+			a = post.Author
+			profiles[post.AuthorID] = a
+		}
+		if a != nil {
+			item.Author = a.Name
+			item.AuthorURL = base + authorPath(a.ID)
+			item.Avatar = a.Avatar
+			if strings.HasPrefix(item.Avatar, "/") {
+				item.Avatar = base + item.Avatar
+			}
+		}
+		f.Items = append(f.Items, item)
+	}
+
+	// The feed changed when its newest entry did. An empty blog's feed is as
+	// new as it is.
+	if !latest.IsZero() {
+		f.Updated = latest
+	}
+	return f, nil
+}
+
+// siteURL is the blog's canonical address, without a trailing slash: the
+// configured BaseURL, or the app's own https address
+func siteURL(b Blog, c appengine.Context) string {
+	if b.BaseURL != "" {
+		return b.BaseURL
+	}
+	return "https://" + appengine.DefaultVersionHostname(c)
+}
+
+// blogURL returns siteURL for handlers that don't otherwise need the blog's
+// settings
+func blogURL(c appengine.Context) (string, error) {
+	b, err := getBlogInfo(c)
+	if err != nil {
+		return "", err
+	}
+	return siteURL(b, c), nil
+}
+
+// parseBaseURL checks a base URL from the settings, normalising it to have
+// no trailing slash. Blank selects the default.
+func parseBaseURL(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("Base URL %q is not an http or https URL without a query", s)
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// expireFeed discards the stored feeds, their pages and authors' feeds, so
+// the next requests rebuild them. Their date check only notices new posts,
+// not edits or settings changes. Archives are expired separately.
+func expireFeed(c appengine.Context) {
+	for _, ff := range feedFormats {
+		memcache.Delete(c, ff.cacheKey)
+		if err := datastore.Delete(c, ff.key(c, feedDoc{Page: 1})); err != nil && err != datastore.ErrNoSuchEntity {
+			c.Warningf("Expiring feed %s: %v", ff.path, err)
+		}
+	}
+	expireFeedDocs(c, ".page-", ".author-")
+}
+
+func lastPostDate(c appengine.Context) (time.Time, error) {
+	p := make([]Post, 0, 1)
+	q := datastore.NewQuery("Post").Order("-Date").Limit(1)
+	q = q.Filter("Hidden =", false)
+	q = q.Project("Date")
+	_, err := q.GetAll(c, &p)
+	if err != nil || len(p) == 0 {
+		// Without posts, any stored feed is current
+		return time.Time{}, err
+	}
+
+	return p[0].Date, nil
+}
@@ -0,0 +1,283 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ *  Feed history (RFC 5005), so readers and backup tools can walk every post.
+ *  Each feed is paged, with "?page=2" and so on holding older posts, linked
+ *  by first, previous, next and last. It's also archived by month, with
+ *  "?archive=2006-01" holding every post from that month, marked with
+ *  fh:archive and linked by prev-archive and next-archive, starting from the
+ *  subscription document's prev-archive.
+ *
+ *  Pages shift whenever a post is added, so are stored and expired with the
+ *  subscription document. Archives only change when their own posts do, or
+ *  a neighbouring month gains its first post or loses its last, so each is
+ *  stored until then.
+ */
+
+// Posts per page, including the subscription document
+const feedPageSize = 10
+
+var errNoFeedDoc = errors.New("No such feed page or archive")
+
+// A feedDoc identifies a document of a feed: a page, the first of which is
+// the subscription document, or a month's archive. An author's feed is a
+// single document of their latest posts.
+type feedDoc struct {
+	Page    int
+	Archive time.Time
+	Author  string
+}
+
+func parseFeedDoc(q url.Values) (feedDoc, bool) {
+	d := feedDoc{Page: 1}
+	if s := q.Get("author"); s != "" {
+		if q.Get("archive") != "" || q.Get("page") != "" {
+			return d, false
+		}
+		return feedDoc{Page: 1, Author: s}, true
+	}
+	if s := q.Get("archive"); s != "" {
+		t, err := time.Parse("2006-01", s)
+		if err != nil || q.Get("page") != "" {
+			return d, false
+		}
+		return feedDoc{Archive: t}, true
+	}
+	if s := q.Get("page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return d, false
+		}
+		d.Page = n
+	}
+	return d, true
+}
+
+func (d feedDoc) isArchive() bool {
+	return !d.Archive.IsZero()
+}
+
+// name distinguishes the document's cache entries. The subscription
+// document's is blank.
+func (d feedDoc) name() string {
+	switch {
+	case d.Author != "":
+		return "author-" + d.Author
+	case d.isArchive():
+		return "archive-" + d.Archive.Format("2006-01")
+	case d.Page > 1:
+		return "page-" + strconv.Itoa(d.Page)
+	}
+	return ""
+}
+
+// links returns a document's own link, and those to the documents around it,
+// given the address of the subscription document
+func (fd *feedData) links(feed string) []Link {
+	page := func(n int) string {
+		if n == 1 {
+			return feed
+		}
+		return feed + "?page=" + strconv.Itoa(n)
+	}
+	archive := func(t time.Time) string {
+		return feed + "?archive=" + t.Format("2006-01")
+	}
+
+	var l []Link
+	if fd.Doc.Author != "" {
+		return append(l, Link{Rel: "self", Href: feed + "?author=" + url.QueryEscape(fd.Doc.Author)})
+	}
+	if fd.Doc.isArchive() {
+		l = append(l, Link{Rel: "self", Href: archive(fd.Doc.Archive)}, Link{Rel: "current", Href: feed})
+	} else {
+		l = append(l,
+			Link{Rel: "self", Href: page(fd.Doc.Page)},
+			Link{Rel: "first", Href: page(1)},
+			Link{Rel: "last", Href: page(fd.Pages)})
+		if fd.Doc.Page > 1 {
+			l = append(l, Link{Rel: "previous", Href: page(fd.Doc.Page - 1)})
+		}
+		if fd.Doc.Page < fd.Pages {
+			l = append(l, Link{Rel: "next", Href: page(fd.Doc.Page + 1)})
+		}
+	}
+
+	if !fd.PrevArchive.IsZero() {
+		l = append(l, Link{Rel: "prev-archive", Href: archive(fd.PrevArchive)})
+	}
+	if !fd.NextArchive.IsZero() {
+		l = append(l, Link{Rel: "next-archive", Href: archive(fd.NextArchive)})
+	}
+	return l
+}
+
+// feedPosts returns the keys of a document's posts, newest first, filling in
+// the links to the documents around it
+func feedPosts(c appengine.Context, f *feedData) ([]*datastore.Key, error) {
+	q := datastore.NewQuery("Post").Filter("Hidden =", false).Order("-Date").KeysOnly()
+
+	if f.Doc.Author != "" {
+		a, err := getAuthor(c, f.Doc.Author)
+		if err == datastore.ErrNoSuchEntity {
+			return nil, errNoFeedDoc
+		} else if err != nil {
+			return nil, err
+		}
+		f.ID = f.ID + ".author-" + a.ID
+		f.Title = f.Title + ": " + a.Name
+		f.Author = a.Name
+		f.Home = f.Base + authorPath(a.ID)
+		return q.Filter("AuthorID =", a.ID).Limit(feedPageSize).GetAll(c, nil)
+	}
+
+	if f.Doc.isArchive() {
+		start := f.Doc.Archive
+		end := start.AddDate(0, 1, 0)
+		keys, err := q.Filter("Date >=", start).Filter("Date <", end).GetAll(c, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, errNoFeedDoc
+		}
+
+		if f.PrevArchive, err = archiveBefore(c, start); err != nil {
+			return nil, err
+		}
+		f.NextArchive, err = archiveFrom(c, end)
+		return keys, err
+	}
+
+	n, err := datastore.NewQuery("Post").Filter("Hidden =", false).KeysOnly().Count(c)
+	if err != nil {
+		return nil, err
+	}
+	f.Pages = (n + feedPageSize - 1) / feedPageSize
+	if f.Pages == 0 {
+		f.Pages = 1
+	}
+	if f.Doc.Page > f.Pages {
+		return nil, errNoFeedDoc
+	}
+
+	keys, err := q.Offset((f.Doc.Page-1)*feedPageSize).Limit(feedPageSize).GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Archives are reached from the subscription document. Its newest post's
+	// month is the latest archive.
+	if f.Doc.Page == 1 && n > 0 {
+		last, err := lastPostDate(c)
+		if err != nil {
+			return nil, err
+		}
+		f.PrevArchive = monthOf(last)
+	}
+	return keys, nil
+}
+
+// monthOf returns the start of the month containing t, in UTC
+func monthOf(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// archiveBefore returns the month of the newest visible post dated before t,
+// or zero if there isn't one
+func archiveBefore(c appengine.Context, t time.Time) (time.Time, error) {
+	p := make([]Post, 0, 1)
+	q := datastore.NewQuery("Post").Filter("Hidden =", false).Filter("Date <", t).
+		Order("-Date").Limit(1).Project("Date")
+	if _, err := q.GetAll(c, &p); err != nil || len(p) == 0 {
+		return time.Time{}, err
+	}
+	return monthOf(p[0].Date), nil
+}
+
+// archiveFrom returns the month of the oldest visible post dated t or later,
+// or zero if there isn't one
+func archiveFrom(c appengine.Context, t time.Time) (time.Time, error) {
+	p := make([]Post, 0, 1)
+	q := datastore.NewQuery("Post").Filter("Hidden =", false).Filter("Date >=", t).
+		Order("Date").Limit(1).Project("Date")
+	if _, err := q.GetAll(c, &p); err != nil || len(p) == 0 {
+		return time.Time{}, err
+	}
+	return monthOf(p[0].Date), nil
+}
+
+// expireArchive discards the archives of the month containing t, and of the
+// months with posts either side, whose links to it may have changed
+func expireArchive(c appengine.Context, t time.Time) {
+	month := monthOf(t)
+	months := []time.Time{month}
+	if prev, err := archiveBefore(c, month); err != nil {
+		c.Warningf("Expiring archives: %v", err)
+	} else if !prev.IsZero() {
+		months = append(months, prev)
+	}
+	if next, err := archiveFrom(c, month.AddDate(0, 1, 0)); err != nil {
+		c.Warningf("Expiring archives: %v", err)
+	} else if !next.IsZero() {
+		months = append(months, next)
+	}
+
+	names := make([]string, 0, len(months)*len(feedFormats))
+	keys := make([]*datastore.Key, 0, cap(names))
+	for _, ff := range feedFormats {
+		for _, m := range months {
+			d := feedDoc{Archive: m}
+			names = append(names, ff.cacheName(d, false))
+			keys = append(keys, ff.key(c, d))
+		}
+	}
+	memcache.DeleteMulti(c, names)
+	if err := datastore.DeleteMulti(c, keys); err != nil {
+		c.Warningf("Expiring archives: %v", err)
+	}
+}
+
+// expireArchives discards every archive, for changes that affect them all,
+// such as the blog's settings, or imports
+func expireArchives(c appengine.Context) {
+	expireFeedDocs(c, ".archive-")
+}
+
+// expireFeedDocs discards the stored documents whose names contain any of
+// the kinds
+func expireFeedDocs(c appengine.Context, kinds ...string) {
+	keys, err := datastore.NewQuery("Feed").KeysOnly().GetAll(c, nil)
+	if err != nil {
+		c.Warningf("Expiring feeds: %v", err)
+		return
+	}
+
+	names := make([]string, 0)
+	expired := make([]*datastore.Key, 0)
+	for _, k := range keys {
+		for _, kind := range kinds {
+			if strings.Contains(k.StringID(), kind) {
+				names = append(names, k.StringID())
+				expired = append(expired, k)
+				break
+			}
+		}
+	}
+	memcache.DeleteMulti(c, names)
+	if err := datastore.DeleteMulti(c, expired); err != nil {
+		c.Warningf("Expiring feeds: %v", err)
+	}
+}
@@ -0,0 +1,518 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ *  Markdown files with front matter, as used by Jekyll and Hugo. "/export"
+ *  downloads every post as a zip of such files, and "/import" takes a zip of
+ *  them, or a single file, as well as WXR.
+ *
+ *  Exported files carry the post's ID, and importing a file with an ID
+ *  recreates the post under that ID, so a blog can be round-tripped through
+ *  a static site generator without breaking links. If the ID is taken by a
+ *  different post, the file is reported as a conflict and not imported;
+ *  removing its "id" imports it as a new post.
+ *
+ *  Front matter is YAML between "---" lines, or TOML between "+++" lines.
+ *  Only the flat subset these generators write is understood: strings,
+ *  numbers, booleans, dates and lists of strings.
+ */
+
+// The marker Hugo uses to end a post's summary. Exports put it between the
+// lead and the rest of the content, so imports can split them the same way.
+const moreMarker = "<!--more-->"
+
+// Limits on what a zip expands to, as a small one can hold far larger files.
+// A post has to fit in a datastore entity, of at most 1MB, anyway.
+const (
+	markdownFileMax  = 1 << 20
+	markdownTotalMax = 32 << 20
+)
+
+// A file to import, from a zip or uploaded on its own
+type markdownFile struct {
+	Name string
+	Data []byte
+}
+
+var (
+	errNoFrontMatter = errors.New("No front matter")
+	fileDateRe       = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})-`)
+	slugRe           = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// exportPost renders a post as markdown with YAML front matter
+func exportPost(p *Post) []byte {
+	var b bytes.Buffer
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "id: %d\n", p.ID)
+	fmt.Fprintf(&b, "title: %s\n", strconv.Quote(p.Title))
+	if p.Description != "" {
+		fmt.Fprintf(&b, "description: %s\n", strconv.Quote(p.Description))
+	}
+	fmt.Fprintf(&b, "date: %s\n", p.Date.Format(time.RFC3339))
+	fmt.Fprintf(&b, "hidden: %t\n", p.Hidden)
+	if len(p.Tags) > 0 {
+		tags := make([]string, len(p.Tags))
+		for i, t := range p.Tags {
+			tags[i] = strconv.Quote(t)
+		}
+		fmt.Fprintf(&b, "tags: [%s]\n", strings.Join(tags, ", "))
+	}
+	if p.Slug != "" {
+		fmt.Fprintf(&b, "slug: %s\n", strconv.Quote(p.Slug))
+	}
+	b.WriteString("---\n")
+
+	b.WriteString(p.Lead)
+	if p.Content != "" {
+		b.WriteString(moreMarker)
+		b.WriteString(p.Content)
+	}
+	return b.Bytes()
+}
+
+// exportName returns a Jekyll style file name for a post, which is the date
+// and the slug, or failing that the ID
+func exportName(p *Post, used map[string]bool) string {
+	slug := strings.Trim(slugRe.ReplaceAllString(strings.ToLower(p.Slug), "-"), "-")
+	if slug == "" {
+		slug = strings.Trim(slugRe.ReplaceAllString(strings.ToLower(p.Title), "-"), "-")
+	}
+	name := p.Date.Format("2006-01-02") + "-" + slug
+	if slug == "" {
+		name += strconv.FormatInt(p.ID, 10)
+	} else if used[name] {
+		name += "-" + strconv.FormatInt(p.ID, 10)
+	}
+	used[name] = true
+	return "posts/" + name + ".md"
+}
+
+// splitFrontMatter separates the front matter from the body, parsing it into
+// strings and string lists
+func splitFrontMatter(doc string) (map[string]interface{}, string, error) {
+	doc = strings.TrimPrefix(strings.Replace(doc, "\r\n", "\n", -1), "\ufeff")
+
+	var delim, sep string
+	switch {
+	case strings.HasPrefix(doc, "---\n"):
+		delim, sep = "---", ":"
+	case strings.HasPrefix(doc, "+++\n"):
+		delim, sep = "+++", "="
+	default:
+		return nil, doc, errNoFrontMatter
+	}
+
+	lines := strings.Split(doc[len(delim)+1:], "\n")
+	end := -1
+	for i, l := range lines {
+		if strings.TrimRight(l, " \t") == delim {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return nil, doc, fmt.Errorf("Front matter has no closing %q", delim)
+	}
+	body := strings.Join(lines[end+1:], "\n")
+	lines = lines[:end]
+
+	fm := map[string]interface{}{}
+	for i := 0; i < len(lines); i++ {
+		l := lines[i]
+		t := strings.TrimSpace(l)
+		if t == "" || t[0] == '#' {
+			continue
+		}
+		if l[0] == ' ' || l[0] == '\t' || t[0] == '-' {
+			// Part of a nested value we don't use
+			continue
+		}
+		if sep == "=" && t[0] == '[' {
+			// The rest is a TOML table, such as Hugo's [params]
+			break
+		}
+
+		n := strings.Index(l, sep)
+		if n < 0 {
+			return nil, body, fmt.Errorf("Expected %q in front matter line %q", sep, t)
+		}
+		key := strings.ToLower(strings.TrimSpace(l[:n]))
+		value := strings.TrimSpace(l[n+1:])
+		if value == "" && sep == "=" {
+			return nil, body, fmt.Errorf("Front matter line %q has no value", t)
+		}
+
+		switch {
+		case value == "" && sep == ":":
+			// A YAML block list, if anything
+			list := make([]string, 0)
+			for i+1 < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i+1]), "-") {
+				i++
+				list = append(list, scalar(strings.TrimSpace(strings.TrimSpace(lines[i])[1:])))
+			}
+			fm[key] = list
+		case sep == ":" && (value[0] == '|' || value[0] == '>'):
+			// A YAML block scalar: the following indented lines
+			block := make([]string, 0)
+			for i+1 < len(lines) && (strings.TrimSpace(lines[i+1]) == "" || lines[i+1][0] == ' ' || lines[i+1][0] == '\t') {
+				i++
+				block = append(block, strings.TrimSpace(lines[i]))
+			}
+			joiner := "\n"
+			if value[0] == '>' {
+				joiner = " "
+			}
+			fm[key] = strings.TrimSpace(strings.Join(block, joiner))
+		case value[0] == '[':
+			fm[key] = flowList(value)
+		default:
+			fm[key] = scalar(value)
+		}
+	}
+	return fm, body, nil
+}
+
+// scalar reads a quoted or plain value
+func scalar(v string) string {
+	switch {
+	case len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"':
+		if s, err := strconv.Unquote(v); err == nil {
+			return s
+		}
+		return v[1 : len(v)-1]
+	case len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'':
+		return strings.Replace(v[1:len(v)-1], "''", "'", -1)
+	}
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
+
+// flowList reads a list like [a, "b, c"], splitting on commas outside quotes
+func flowList(v string) []string {
+	v = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(v, "["), "]"))
+	list := make([]string, 0)
+	var quote byte
+	start := 0
+	for i := 0; i <= len(v); i++ {
+		switch {
+		case i == len(v) || (quote == 0 && v[i] == ','):
+			if item := strings.TrimSpace(v[start:i]); item != "" {
+				list = append(list, scalar(item))
+			}
+			start = i + 1
+		case quote == 0 && (v[i] == '"' || v[i] == '\''):
+			quote = v[i]
+		case quote != 0 && v[i] == '\\' && quote == '"':
+			i++
+		case v[i] == quote:
+			quote = 0
+		}
+	}
+	return list
+}
+
+func fmString(fm map[string]interface{}, key string) string {
+	s, _ := fm[key].(string)
+	return s
+}
+
+func fmList(fm map[string]interface{}, key string) []string {
+	switch v := fm[key].(type) {
+	case []string:
+		return v
+	case string:
+		// Jekyll allows a space separated string
+		return strings.Fields(v)
+	}
+	return nil
+}
+
+var frontMatterDates = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 -07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func parseFrontMatterDate(s string) (time.Time, bool) {
+	for _, layout := range frontMatterDates {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// markdownPost converts a file to a Post. The ID is set if the front matter
+// has one.
+func markdownPost(f markdownFile) (Post, error) {
+	fm, body, err := splitFrontMatter(string(f.Data))
+	if err != nil {
+		return Post{}, err
+	}
+
+	base := path.Base(f.Name)
+	p := Post{
+		Title:       fmString(fm, "title"),
+		Description: fmString(fm, "description"),
+		Slug:        fmString(fm, "slug"),
+	}
+	if p.Title == "" {
+		p.Title = strings.TrimSuffix(base, path.Ext(base))
+	}
+	if p.Description == "" {
+		p.Description = fmString(fm, "summary")
+	}
+
+	if s := fmString(fm, "id"); s != "" {
+		if p.ID, err = strconv.ParseInt(s, 10, 64); err != nil || p.ID <= 0 {
+			return p, fmt.Errorf("Invalid id %q", s)
+		}
+	}
+
+	// Jekyll dates posts by their file name, if not in the front matter
+	date := fmString(fm, "date")
+	if date == "" {
+		if m := fileDateRe.FindStringSubmatch(base); m != nil {
+			date = m[1]
+		}
+	}
+	var ok bool
+	if date == "" {
+		p.Date = time.Now()
+	} else if p.Date, ok = parseFrontMatterDate(date); !ok {
+		return p, fmt.Errorf("Unrecognised date %q", date)
+	}
+
+	// Dinghy's hidden, Hugo's draft, or Jekyll's published
+	p.Hidden = fmString(fm, "hidden") == "true" || fmString(fm, "draft") == "true" ||
+		fmString(fm, "published") == "false"
+
+	p.Tags = cleanTags(append(fmList(fm, "tags"), fmList(fm, "categories")...))
+
+	if i := strings.Index(body, moreMarker); i >= 0 {
+		p.Lead, p.Content = body[:i], body[i+len(moreMarker):]
+	} else {
+		p.Lead, p.Content = splitLead(body)
+	}
+	return p, nil
+}
+
+// readMarkdownFiles returns the markdown files in an uploaded zip, or the
+// upload itself if it isn't a zip
+func readMarkdownFiles(f multipart.File, name string) ([]markdownFile, error) {
+	size, err := f.Seek(0, 2)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		if _, err := f.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(f)
+		return []markdownFile{{name, data}}, err
+	}
+
+	files := make([]markdownFile, 0, len(zr.File))
+	total := 0
+	for _, zf := range zr.File {
+		base := path.Base(zf.Name)
+		ext := strings.ToLower(path.Ext(base))
+		if zf.FileInfo().IsDir() || strings.HasPrefix(base, ".") || strings.Contains(zf.Name, "__MACOSX/") ||
+			(ext != ".md" && ext != ".markdown") {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(rc, markdownFileMax+1))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Reading %s: %v", zf.Name, err)
+		}
+		if len(data) > markdownFileMax {
+			return nil, fmt.Errorf("%s is larger than %d bytes", zf.Name, markdownFileMax)
+		}
+		if total += len(data); total > markdownTotalMax {
+			return nil, fmt.Errorf("The zip's markdown files are larger than %d bytes in all", markdownTotalMax)
+		}
+		files = append(files, markdownFile{zf.Name, data})
+	}
+	return files, nil
+}
+
+// checkID returns why a post can't be imported under its own ID, if it
+// can't. conflict is false when the post is already there.
+func checkID(c appengine.Context, p *Post, claimed map[int64]string) (skip string, conflict bool, err error) {
+	if title, ok := claimed[p.ID]; ok {
+		return fmt.Sprintf("ID %d is also used by %q in this import", p.ID, title), true, nil
+	}
+
+	old := Post{}
+	err = datastore.Get(c, datastore.NewKey(c, "Post", "", p.ID, nil), &old)
+	switch {
+	case err == datastore.ErrNoSuchEntity:
+		return "", false, nil
+	case err != nil:
+		return "", false, err
+	case old.Title == p.Title && old.Date.Equal(p.Date):
+		return "Already imported", false, nil
+	}
+	return fmt.Sprintf("ID %d is used by %q", p.ID, old.Title), true, nil
+}
+
+// importMarkdown imports markdown files with front matter. A dry run only
+// reports.
+//
+// The datastore doesn't know which IDs we've chosen, so could in principle
+// give one to a new post later, but with scattered IDs that's vanishingly
+// unlikely.
+func importMarkdown(c appengine.Context, files []markdownFile, dryRun bool) (ImportReport, error) {
+	report := ImportReport{DryRun: dryRun, Items: make([]ImportItem, 0)}
+	claimed := map[int64]string{}
+
+	for _, f := range files {
+		p, err := markdownPost(f)
+		item := ImportItem{
+			Title:  p.Title,
+			Type:   "post",
+			Date:   p.Date,
+			Hidden: p.Hidden,
+			Tags:   p.Tags,
+			File:   f.Name,
+		}
+		if err != nil {
+			item.Skip = err.Error()
+			report.Skipped++
+			report.Items = append(report.Items, item)
+			continue
+		}
+
+		var conflict bool
+		save := func(c appengine.Context) error {
+			k := datastore.NewIncompleteKey(c, "Post", nil)
+			if p.ID != 0 {
+				if item.Skip, conflict, err = checkID(c, &p, claimed); err != nil || item.Skip != "" {
+					return err
+				}
+				k = datastore.NewKey(c, "Post", "", p.ID, nil)
+			}
+			if dryRun {
+				return nil
+			}
+
+			p.Updated = time.Now()
+			k, err = datastore.Put(c, k, &p)
+			p.ID = k.IntID()
+			return err
+		}
+		if p.ID != 0 && !dryRun {
+			err = datastore.RunInTransaction(c, save, nil)
+		} else {
+			err = save(c)
+		}
+		if err != nil {
+			return report, err
+		}
+
+		switch {
+		case conflict:
+			report.Conflicts++
+		case item.Skip != "":
+			report.Skipped++
+		default:
+			if p.ID != 0 {
+				claimed[p.ID] = p.Title
+				item.NewURL = "/" + strconv.FormatInt(p.ID, 10)
+			}
+			if !dryRun {
+				// As with WXR, imports don't notify anyone about old posts
+				if err := indexPost(c, p.ID, &p); err != nil {
+					return report, err
+				}
+			}
+			report.Imported++
+		}
+		report.Items = append(report.Items, item)
+	}
+
+	if !dryRun && report.Imported > 0 {
+		memcache.Flush(c)
+		expireFeed(c)
+		expireArchives(c)
+	}
+	return report, nil
+}
+
+// AJAX functions
+
+// exportPosts downloads every post, hidden or not, as a zip of markdown files
+func exportPosts(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	posts := make([]Post, 0)
+	keys, err := datastore.NewQuery("Post").Order("-Date").GetAll(c, &posts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Built in memory, so an error can still be reported
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	used := map[string]bool{}
+	for i := range posts {
+		p := &posts[i]
+		p.ID = keys[i].IntID()
+
+		h := &zip.FileHeader{Name: exportName(p, used), Method: zip.Deflate}
+		if p.Updated.IsZero() {
+			h.SetModTime(p.Date)
+		} else {
+			h.SetModTime(p.Updated)
+		}
+		fw, err := zw.CreateHeader(h)
+		if err == nil {
+			_, err = fw.Write(exportPost(p))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="posts-%s.zip"`, time.Now().Format("2006-01-02")))
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,314 @@
+package dinghy
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitFrontMatter(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		fm   map[string]interface{}
+		body string
+	}{
+		{
+			"yaml scalars",
+			"---\ntitle: \"A \\\"quoted\\\" post\"\nslug: 'it''s'\nsummary: plain text # a comment\nDate: 2014-03-01\n---\nBody\n",
+			map[string]interface{}{"title": `A "quoted" post`, "slug": "it's", "summary": "plain text", "date": "2014-03-01"},
+			"Body\n",
+		},
+		{
+			"yaml block list",
+			"---\ntags:\n  - go\n  - \"app engine\"\n- 'blogs'\ntitle: Lists\n---\n",
+			map[string]interface{}{"tags": []string{"go", "app engine", "blogs"}, "title": "Lists"},
+			"",
+		},
+		{
+			"yaml empty value",
+			"---\ntags:\ntitle: Nothing\n---\n",
+			map[string]interface{}{"tags": []string{}, "title": "Nothing"},
+			"",
+		},
+		{
+			"yaml literal block scalar",
+			"---\ndescription: |\n  First line\n\n  Second line\ntitle: Blocks\n---\n",
+			map[string]interface{}{"description": "First line\n\nSecond line", "title": "Blocks"},
+			"",
+		},
+		{
+			"yaml folded block scalar",
+			"---\ndescription: >-\n  Folded\n  together\n---\n",
+			map[string]interface{}{"description": "Folded together"},
+			"",
+		},
+		{
+			"yaml nested values ignored",
+			"---\ntitle: Nested\nauthor:\n  name: Someone\n  url: https://someone.example\n# A comment\n---\n",
+			map[string]interface{}{"title": "Nested", "author": []string{}},
+			"",
+		},
+		{
+			"flow list with quoted commas",
+			"---\ntags: [go, \"a, b\", 'c, d', \"say \\\"hi\\\", then\"]\n---\n",
+			map[string]interface{}{"tags": []string{"go", "a, b", "c, d", `say "hi", then`}},
+			"",
+		},
+		{
+			"empty flow list",
+			"---\ntags: []\n---\n",
+			map[string]interface{}{"tags": []string{}},
+			"",
+		},
+		{
+			"toml",
+			"+++\ntitle = \"TOML\"\ndate = 2014-03-01T10:00:00Z\ndraft = true\ntags = [\"go\", \"x, y\"]\n+++\nBody\n",
+			map[string]interface{}{"title": "TOML", "date": "2014-03-01T10:00:00Z", "draft": "true", "tags": []string{"go", "x, y"}},
+			"Body\n",
+		},
+		{
+			"toml table",
+			"+++\ntitle = \"Tables\"\n[params]\nsubtitle = \"Ignored\"\n\n[[menu.main]]\nname = \"Also ignored\"\n+++\n",
+			map[string]interface{}{"title": "Tables"},
+			"",
+		},
+		{
+			"crlf and bom",
+			"\ufeff---\r\ntitle: Windows\r\n---  \r\nLine one\r\nLine two\r\n",
+			map[string]interface{}{"title": "Windows"},
+			"Line one\nLine two\n",
+		},
+		{
+			"delimiter in body",
+			"---\ntitle: Rules\n---\nAbove\n---\nBelow\n",
+			map[string]interface{}{"title": "Rules"},
+			"Above\n---\nBelow\n",
+		},
+	}
+
+	for _, tt := range tests {
+		fm, body, err := splitFrontMatter(tt.doc)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(fm, tt.fm) {
+			t.Errorf("%s: front matter %#v, want %#v", tt.name, fm, tt.fm)
+		}
+		if body != tt.body {
+			t.Errorf("%s: body %q, want %q", tt.name, body, tt.body)
+		}
+	}
+}
+
+func TestSplitFrontMatterErrors(t *testing.T) {
+	tests := map[string]string{
+		"no front matter":    "# Just markdown\n",
+		"unclosed":           "---\ntitle: Open\n",
+		"missing separator":  "---\ntitle: A\nno separator\n---\n",
+		"toml without value": "+++\ntitle = \"A post\"\ndate =\n+++\nBody\n",
+		"toml with colons":   "+++\ntitle: \"YAML\"\n+++\n",
+	}
+	for name, doc := range tests {
+		if _, _, err := splitFrontMatter(doc); err == nil {
+			t.Errorf("%s: splitFrontMatter accepted %q", name, doc)
+		}
+	}
+}
+
+func TestMarkdownPostDates(t *testing.T) {
+	utc := func(y int, m time.Month, d, h, min int) time.Time {
+		return time.Date(y, m, d, h, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		file markdownFile
+		date time.Time
+	}{
+		{"rfc 3339", markdownFile{"a.md", []byte("---\ndate: 2014-03-01T10:30:00+10:00\n---\n")}, utc(2014, 3, 1, 0, 30)},
+		{"jekyll", markdownFile{"a.md", []byte("---\ndate: 2014-03-01 10:30:00 -0500\n---\n")}, utc(2014, 3, 1, 15, 30)},
+		{"jekyll with colon", markdownFile{"a.md", []byte("---\ndate: 2014-03-01 10:30:00 +01:00\n---\n")}, utc(2014, 3, 1, 9, 30)},
+		{"quoted, no zone", markdownFile{"a.md", []byte("---\ndate: \"2014-03-01T10:30:00\"\n---\n")}, utc(2014, 3, 1, 10, 30)},
+		{"minutes", markdownFile{"a.md", []byte("---\ndate: 2014-03-01 10:30\n---\n")}, utc(2014, 3, 1, 10, 30)},
+		{"day", markdownFile{"a.md", []byte("+++\ndate = 2014-03-01\n+++\n")}, utc(2014, 3, 1, 0, 0)},
+		{"file name", markdownFile{"_posts/2014-03-01-a-post.md", []byte("---\ntitle: A\n---\n")}, utc(2014, 3, 1, 0, 0)},
+		{"front matter over file name", markdownFile{"2013-01-01-a.md", []byte("---\ndate: 2014-03-01\n---\n")}, utc(2014, 3, 1, 0, 0)},
+	}
+	for _, tt := range tests {
+		p, err := markdownPost(tt.file)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !p.Date.Equal(tt.date) {
+			t.Errorf("%s: date %v, want %v", tt.name, p.Date, tt.date)
+		}
+	}
+
+	before := time.Now()
+	p, err := markdownPost(markdownFile{"undated.md", []byte("---\ntitle: Undated\n---\n")})
+	if err != nil || p.Date.Before(before) {
+		t.Errorf("Undated post dated %v (%v), want now", p.Date, err)
+	}
+
+	if _, err := markdownPost(markdownFile{"a.md", []byte("---\ndate: 1 March 2014\n---\n")}); err == nil {
+		t.Error("markdownPost accepted an unrecognised date")
+	}
+}
+
+func TestMarkdownPostFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   markdownFile
+		hidden bool
+		check  func(p Post) bool
+	}{
+		{"published", markdownFile{"a.md", []byte("---\ntitle: A\n---\n")}, false, nil},
+		{"dinghy hidden", markdownFile{"a.md", []byte("---\nhidden: true\n---\n")}, true, nil},
+		{"hugo draft", markdownFile{"a.md", []byte("+++\ndraft = true\n+++\n")}, true, nil},
+		{"hugo not draft", markdownFile{"a.md", []byte("+++\ndraft = false\n+++\n")}, false, nil},
+		{"jekyll unpublished", markdownFile{"a.md", []byte("---\npublished: false\n---\n")}, true, nil},
+		{"jekyll published", markdownFile{"a.md", []byte("---\npublished: true\n---\n")}, false, nil},
+		{"title from file name", markdownFile{"posts/2014-03-01-hello.markdown", []byte("---\n---\n")}, false,
+			func(p Post) bool { return p.Title == "2014-03-01-hello" }},
+		{"summary as description", markdownFile{"a.md", []byte("---\nsummary: In short\n---\n")}, false,
+			func(p Post) bool { return p.Description == "In short" }},
+		{"tags and categories", markdownFile{"a.md", []byte("---\ntags: go appengine\ncategories: [Go, blogs]\n---\n")}, false,
+			func(p Post) bool { return reflect.DeepEqual(p.Tags, []string{"go", "appengine", "blogs"}) }},
+		{"more marker", markdownFile{"a.md", []byte("---\n---\nLead\n<!--more-->\nRest\n")}, false,
+			func(p Post) bool { return p.Lead == "Lead\n" && p.Content == "\nRest\n" }},
+		{"id", markdownFile{"a.md", []byte("---\nid: 42\n---\n")}, false,
+			func(p Post) bool { return p.ID == 42 }},
+	}
+	for _, tt := range tests {
+		p, err := markdownPost(tt.file)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if p.Hidden != tt.hidden {
+			t.Errorf("%s: hidden %t, want %t", tt.name, p.Hidden, tt.hidden)
+		}
+		if tt.check != nil && !tt.check(p) {
+			t.Errorf("%s: unexpected post %+v", tt.name, p)
+		}
+	}
+
+	for _, id := range []string{"0", "-1", "abc"} {
+		if _, err := markdownPost(markdownFile{"a.md", []byte("---\nid: " + id + "\n---\n")}); err == nil {
+			t.Errorf("markdownPost accepted id %s", id)
+		}
+	}
+}
+
+func TestExportPostRoundTrip(t *testing.T) {
+	posts := []Post{
+		{
+			ID:          12,
+			Title:       `A "quoted" title: with # and, commas`,
+			Description: "Line one\nline two, 'quoted'",
+			Date:        time.Date(2014, 3, 1, 10, 30, 0, 0, time.FixedZone("AEST", 10*60*60)),
+			Tags:        []string{"go", "a, b", `say "hi"`},
+			Slug:        "a-quoted-title",
+			Lead:        "The lead, in *markdown*.\n\n",
+			Content:     "---\n\nThe rest, after a rule.\n",
+		},
+		{
+			ID:     13,
+			Title:  "Ünïcödé ✓",
+			Date:   time.Date(2015, 12, 31, 23, 59, 59, 0, time.UTC),
+			Hidden: true,
+			Lead:   "Only a lead\n",
+		},
+	}
+
+	for _, want := range posts {
+		got, err := markdownPost(markdownFile{"posts/x.md", exportPost(&want)})
+		if err != nil {
+			t.Errorf("Post %d: %v", want.ID, err)
+			continue
+		}
+		if got.ID != want.ID || got.Title != want.Title || got.Description != want.Description ||
+			!got.Date.Equal(want.Date) || got.Hidden != want.Hidden || got.Slug != want.Slug ||
+			got.Lead != want.Lead || got.Content != want.Content {
+			t.Errorf("Post %d came back as %+v, want %+v", want.ID, got, want)
+		}
+		if len(want.Tags) > 0 && !reflect.DeepEqual(got.Tags, want.Tags) {
+			t.Errorf("Post %d tags came back as %q, want %q", want.ID, got.Tags, want.Tags)
+		}
+	}
+}
+
+// An upload, as readMarkdownFiles gets it
+type uploadFile struct {
+	*bytes.Reader
+}
+
+func (uploadFile) Close() error { return nil }
+
+func zipFiles(t *testing.T, files map[string]string) uploadFile {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return uploadFile{bytes.NewReader(buf.Bytes())}
+}
+
+func TestReadMarkdownFiles(t *testing.T) {
+	f := zipFiles(t, map[string]string{
+		"posts/a.md":          "---\ntitle: A\n---\n",
+		"posts/b.markdown":    "---\ntitle: B\n---\n",
+		"posts/image.png":     "not markdown",
+		"posts/.hidden.md":    "---\n---\n",
+		"__MACOSX/posts/c.md": "resource fork",
+		"README.MD":           "---\ntitle: Readme\n---\n",
+	})
+	files, err := readMarkdownFiles(f, "posts.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, mf := range files {
+		names[mf.Name] = true
+	}
+	if want := map[string]bool{"posts/a.md": true, "posts/b.markdown": true, "README.MD": true}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Read %v, want %v", names, want)
+	}
+
+	single := "---\ntitle: Single\n---\n"
+	files, err = readMarkdownFiles(uploadFile{bytes.NewReader([]byte(single))}, "single.md")
+	if err != nil || len(files) != 1 || files[0].Name != "single.md" || string(files[0].Data) != single {
+		t.Errorf("Single file read as %v (%v)", files, err)
+	}
+}
+
+func TestReadMarkdownFilesLimits(t *testing.T) {
+	// Repeated bytes compress to almost nothing
+	big := strings.Repeat("a", markdownFileMax+1)
+	if _, err := readMarkdownFiles(zipFiles(t, map[string]string{"big.md": big}), "big.zip"); err == nil {
+		t.Error("readMarkdownFiles read a file over the limit")
+	}
+	if _, err := readMarkdownFiles(zipFiles(t, map[string]string{"big.md": big[1:]}), "big.zip"); err != nil {
+		t.Errorf("readMarkdownFiles refused a file at the limit: %v", err)
+	}
+
+	many := make(map[string]string)
+	for i := 0; i <= markdownTotalMax/markdownFileMax; i++ {
+		many[strings.Repeat("x", i+1)+".md"] = big[1:]
+	}
+	if _, err := readMarkdownFiles(zipFiles(t, many), "many.zip"); err == nil {
+		t.Error("readMarkdownFiles read files over the total limit")
+	}
+}
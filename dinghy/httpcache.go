@@ -0,0 +1,295 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/memcache"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ *  HTTP caching for pages and feeds. Each rendered document is kept in
+ *  memcache with its validators: a strong ETag hashed from its content, and
+ *  the time it was rendered as its Last-Modified. Clients revalidating with
+ *  If-None-Match or If-Modified-Since get 304 Not Modified instead of the
+ *  body, so feed readers polling every few minutes only download a feed when
+ *  it changes.
+ *
+ *  Edits, deletions, settings and template changes don't date any post, so
+ *  Last-Modified can't be taken from post dates; documents are rendered
+ *  again after any change, which moves it forward. The ETag is still the
+ *  better validator, and as RFC 7232 requires, If-Modified-Since is only
+ *  considered when a request has no If-None-Match.
+ *
+ *  Cache-Control is set per path, from the blog's settings or the defaults
+ *  below. Admins see hidden posts, so their pages are never cached.
+ *
+ *  Documents are compressed once, when they are cached, and each encoding is
+ *  kept alongside the raw bytes. Responses pick one by the request's
+ *  Accept-Encoding, so serving from memcache does no compression work.
+ */
+
+// A CacheRule sets the Cache-Control header of the paths starting with Path.
+// The longest matching Path applies.
+type CacheRule struct {
+	Path       string
+	Directives string
+}
+
+// defaultCacheRules apply when the blog's settings have none. Pages are
+// always revalidated, which is cheap with ETags, while readers may keep feeds
+// for a few minutes.
+var defaultCacheRules = []CacheRule{
+	{"/", "public, no-cache"},
+	{"/atom.xml", "public, max-age=300"},
+	{"/rss.xml", "public, max-age=300"},
+	{"/feed.json", "public, max-age=300"},
+}
+
+// Sent with pages rendered for admins
+const privateCacheControl = "private, no-cache"
+
+// cacheControl returns the Cache-Control header for a path, or blank for none
+func cacheControl(b Blog, path string) string {
+	rules := b.CacheControl
+	if len(rules) == 0 {
+		rules = defaultCacheRules
+	}
+
+	match := CacheRule{}
+	for _, rule := range rules {
+		if strings.HasPrefix(path, rule.Path) && len(rule.Path) >= len(match.Path) {
+			match = rule
+		}
+	}
+	return match.Directives
+}
+
+// parseCacheRules reads the rules from the settings form, one per line, each
+// a path followed by its directives, e.g. "/atom.xml public, max-age=300"
+func parseCacheRules(s string) ([]CacheRule, error) {
+	rules := make([]CacheRule, 0)
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		f := strings.SplitN(line, " ", 2)
+		if len(f) < 2 {
+			return nil, fmt.Errorf("Cache rule %q needs a path and directives", line)
+		}
+		rules = append(rules, CacheRule{f[0], strings.TrimSpace(f[1])})
+	}
+	return rules, validateCacheRules(rules)
+}
+
+func validateCacheRules(rules []CacheRule) error {
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("Cache rule path %q must start with /", rule.Path)
+		}
+		if rule.Directives == "" || strings.ContainsAny(rule.Directives, "\r\n") {
+			return fmt.Errorf("Cache rule for %s has invalid directives", rule.Path)
+		}
+	}
+	return nil
+}
+
+// A contentEncoding is a compressed variant kept with each cached document
+type contentEncoding struct {
+	name     string
+	compress func([]byte) ([]byte, error)
+}
+
+// contentEncodings are in order of preference. Brotli would come first, but
+// the standard library has no encoder for it.
+var contentEncodings = []contentEncoding{
+	{"gzip", gzipBytes},
+}
+
+// Documents smaller than this aren't worth compressing
+const minCompressSize = 512
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	z, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := z.Write(b); err != nil {
+		return nil, err
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// A cachedPage is a rendered page or feed document, as kept in memcache
+type cachedPage struct {
+	Body         []byte
+	ContentType  string
+	ETag         string
+	Modified     time.Time
+	CacheControl string
+	// Compressed bodies by content coding
+	Encoded map[string][]byte
+}
+
+func newCachedPage(body []byte, contentType string, modified time.Time, cacheControl string) *cachedPage {
+	p := &cachedPage{
+		Body:         body,
+		ContentType:  contentType,
+		ETag:         contentETag(body),
+		Modified:     modified,
+		CacheControl: cacheControl,
+		Encoded:      make(map[string][]byte),
+	}
+	if len(body) < minCompressSize {
+		return p
+	}
+	for _, ce := range contentEncodings {
+		// A failure only loses the variant
+		if z, err := ce.compress(body); err == nil && len(z) < len(body) {
+			p.Encoded[ce.name] = z
+		}
+	}
+	return p
+}
+
+func getCachedPage(c appengine.Context, key string) (*cachedPage, error) {
+	p := &cachedPage{}
+	_, err := memcache.Gob.Get(c, key, p)
+	return p, err
+}
+
+func (p *cachedPage) cache(c appengine.Context, key string) {
+	item := &memcache.Item{
+		Key:    key,
+		Object: p,
+	}
+	memcache.Gob.Set(c, item)
+}
+
+// write sends the page in the best encoding the client accepts, or 304 Not
+// Modified if the client's copy is current
+func (p *cachedPage) write(w http.ResponseWriter, r *http.Request) {
+	body, etag := p.Body, p.ETag
+	coding := p.negotiate(r.Header.Get("Accept-Encoding"))
+	if coding != "" {
+		// Each encoding is a different representation, so has its own ETag
+		body = p.Encoded[coding]
+		etag = strings.TrimSuffix(etag, `"`) + "-" + coding + `"`
+	}
+
+	h := w.Header()
+	h.Set("Vary", "Accept-Encoding")
+	if p.CacheControl != "" {
+		h.Set("Cache-Control", p.CacheControl)
+	}
+	h.Set("ETag", etag)
+	if !p.Modified.IsZero() {
+		h.Set("Last-Modified", p.Modified.UTC().Format(http.TimeFormat))
+	}
+
+	if isNotModified(r, etag, p.Modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", p.ContentType)
+	if coding != "" {
+		h.Set("Content-Encoding", coding)
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+// negotiate picks the most preferred stored encoding that an Accept-Encoding
+// header allows, or blank for the raw body
+func (p *cachedPage) negotiate(accept string) string {
+	q := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		f := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(f[0]))
+		if name == "" {
+			continue
+		}
+		q[name] = 1
+		for _, param := range f[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					v = 0
+				}
+				q[name] = v
+			}
+		}
+	}
+
+	for _, ce := range contentEncodings {
+		if _, ok := p.Encoded[ce.name]; !ok {
+			continue
+		}
+		v, ok := q[ce.name]
+		if !ok {
+			v, ok = q["*"]
+		}
+		if ok && v > 0 {
+			return ce.name
+		}
+	}
+	return ""
+}
+
+// isNotModified evaluates a GET request's If-None-Match, or failing that its
+// If-Modified-Since, against a document's validators
+func isNotModified(r *http.Request, etag string, modified time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	// If-None-Match uses the weak comparison
+	if m := r.Header.Get("If-None-Match"); m != "" {
+		for _, t := range strings.Split(m, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == etag || t == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// contentETag returns a strong validator for a document's content
+func contentETag(body []byte) string {
+	h := sha1.Sum(body)
+	return `"` + hex.EncodeToString(h[:]) + `"`
+}
+
+// newestPost returns the latest date of the posts, or zero for none
+func newestPost(posts []Post) time.Time {
+	var t time.Time
+	for _, p := range posts {
+		if p.Date.After(t) {
+			t = p.Date
+		}
+		if p.Updated.After(t) {
+			t = p.Updated
+		}
+	}
+	return t
+}
@@ -0,0 +1,83 @@
+package dinghy
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// JSON Feed 1.1 (https://www.jsonfeed.org/version/1.1/)
+type jsonFeedDoc struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	Description string           `json:"description,omitempty"`
+	Authors     []jsonFeedAuthor `json:"authors,omitempty"`
+	NextURL     string           `json:"next_url,omitempty"`
+	Hubs        []jsonFeedHub    `json:"hubs,omitempty"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name   string `json:"name"`
+	URL    string `json:"url,omitempty"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
+type jsonFeedHub struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type jsonFeedItem struct {
+	ID            string           `json:"id"`
+	URL           string           `json:"url"`
+	Title         string           `json:"title"`
+	ContentHTML   string           `json:"content_html"`
+	Summary       string           `json:"summary,omitempty"`
+	DatePublished string           `json:"date_published"`
+	DateModified  string           `json:"date_modified"`
+	Tags          []string         `json:"tags,omitempty"`
+	Authors       []jsonFeedAuthor `json:"authors,omitempty"`
+}
+
+// renderJSONFeed renders a feed as JSON Feed 1.1
+func renderJSONFeed(fd *feedData, feed string) ([]byte, error) {
+	doc := jsonFeedDoc{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       fd.Title,
+		HomePageURL: fd.Home,
+		FeedURL:     feed,
+		Description: fd.Description,
+		Authors:     []jsonFeedAuthor{{Name: fd.Author}},
+		Items:       make([]jsonFeedItem, len(fd.Items)),
+	}
+	// JSON Feed pages by next_url, and has no archives. An author's feed is
+	// its own feed.
+	for _, l := range fd.links(feed) {
+		switch {
+		case l.Rel == "next":
+			doc.NextURL = l.Href
+		case l.Rel == "self" && fd.Doc.Author != "":
+			doc.FeedURL = l.Href
+		}
+	}
+	for _, hub := range fd.Hubs {
+		doc.Hubs = append(doc.Hubs, jsonFeedHub{"WebSub", hub})
+	}
+
+	for i, it := range fd.Items {
+		doc.Items[i] = jsonFeedItem{
+			ID:            it.ID,
+			URL:           it.URL,
+			Title:         it.Title,
+			ContentHTML:   it.HTML,
+			Summary:       it.Summary,
+			DatePublished: it.Published.UTC().Format(time.RFC3339),
+			DateModified:  it.Updated.UTC().Format(time.RFC3339),
+			Tags:          it.Tags,
+			Authors:       []jsonFeedAuthor{{it.Author, it.AuthorURL, it.Avatar}},
+		}
+	}
+	return json.MarshalIndent(doc, "", "    ")
+}
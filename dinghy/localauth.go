@@ -0,0 +1,704 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+ *  Local accounts, for standalone deployments without the App Engine Users
+ *  service, selected with DINGHY_AUTH=local. Each Account has a bcrypt-hashed
+ *  password, and may add a TOTP secret (see totp.go) for two-factor login.
+ *  Logging in at /login starts a Session, whose secret is kept in an HttpOnly,
+ *  Secure cookie; as with API tokens, only a hash of it is stored. Sessions
+ *  last two weeks, or until logging out.
+ *
+ *  Until there are any accounts, /login creates the first, as an
+ *  administrator, for whoever also gives the setup key the blog was deployed
+ *  with, in DINGHY_SETUP_KEY. Without one, no account can be created. After
+ *  too many failed attempts, logins to an account, or setup, are refused for
+ *  a while.
+ */
+
+// An Account is a local login, stored with its login name as its key name.
+// Admin accounts are owners; others take their author's Role.
+type Account struct {
+	PasswordHash []byte `datastore:",noindex"`
+	Admin        bool   `datastore:",noindex"`
+	TOTPSecret   string `datastore:",noindex"`
+	// A TOTP secret being set up, until a code from it is confirmed
+	PendingTOTP string `datastore:",noindex"`
+	// The time step of the last code used
+	TOTPStep int64 `datastore:",noindex"`
+	Created  time.Time
+}
+
+// A Session is a local login, stored with a SHA-256 hash of its cookie's
+// secret as its key name
+type Session struct {
+	Login   string
+	Expires time.Time `datastore:",noindex"`
+}
+
+// accountInfo describes an account to the admin page
+type accountInfo struct {
+	Login     string
+	Admin     bool
+	TwoFactor bool
+	Created   time.Time
+}
+
+const (
+	sessionCookie   = "dinghy_session"
+	sessionLifetime = 14 * 24 * time.Hour
+
+	minPasswordLength = 8
+	// bcrypt only uses this many bytes
+	maxPasswordLength = 72
+
+	maxLoginFailures = 10
+	loginLockout     = 15 * time.Minute
+)
+
+var (
+	errBadLogin  = errors.New("Incorrect login or password")
+	errBadCode   = errors.New("Incorrect or missing two-factor code")
+	errLockedOut = errors.New("Too many failed logins, try again later")
+	errNotLocal  = errors.New("This blog uses App Engine logins, not its own accounts")
+
+	errNoSetupKey  = errors.New("Set DINGHY_SETUP_KEY when deploying the blog to create its first account")
+	errBadSetupKey = errors.New("Incorrect setup key")
+	errSetupDone   = errors.New("The blog already has an account, log in with it")
+	errSelfDemote  = errors.New("You can't remove your own administrator access")
+)
+
+// Failed setups are counted as if they were logins to this account, which
+// can't exist, as logins can't have spaces
+const setupLogin = " setup"
+
+// Logins to the blog's own accounts
+type localAuth struct{}
+
+func (localAuth) current(c appengine.Context, r *http.Request) *authUser {
+	ck, err := r.Cookie(sessionCookie)
+	if err != nil || ck.Value == "" {
+		return nil
+	}
+	k := datastore.NewKey(c, "Session", hashSecret(ck.Value), 0, nil)
+	s := Session{}
+	if err := datastore.Get(c, k, &s); err != nil {
+		return nil
+	}
+	if time.Now().After(s.Expires) {
+		datastore.Delete(c, k)
+		return nil
+	}
+
+	// Deleting an account ends its sessions
+	a, err := getAccount(c, s.Login)
+	if err != nil {
+		return nil
+	}
+	return &authUser{Login: s.Login, Admin: a.Admin, ID: k.StringID()}
+}
+
+func (localAuth) loginURL(c appengine.Context, r *http.Request, dest string) (string, error) {
+	return "/login?" + url.Values{"continue": {dest}}.Encode(), nil
+}
+
+// Logging out changes state, so the address carries the CSRF token
+func (l localAuth) logoutURL(c appengine.Context, r *http.Request, dest string) (string, error) {
+	u := l.current(c, r)
+	if u == nil {
+		return dest, nil
+	}
+	t, err := csrfToken(c, u)
+	if err != nil {
+		return "", err
+	}
+	return "/logout?" + url.Values{"csrf": {t}, "continue": {dest}}.Encode(), nil
+}
+
+// Accounts share a parent, so that setup can check there are none in the
+// same transaction that creates the first
+func accountsKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Accounts", "accounts", 0, nil)
+}
+
+func accountKey(c appengine.Context, login string) *datastore.Key {
+	return datastore.NewKey(c, "Account", login, 0, accountsKey(c))
+}
+
+func getAccount(c appengine.Context, login string) (Account, error) {
+	a := Account{}
+	if login == "" {
+		return a, datastore.ErrNoSuchEntity
+	}
+	err := datastore.Get(c, accountKey(c, login), &a)
+	return a, err
+}
+
+// updateAccount changes an existing account in a transaction
+func updateAccount(c appengine.Context, login string, f func(a *Account) error) error {
+	k := accountKey(c, login)
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		a := Account{}
+		if err := datastore.Get(tc, k, &a); err != nil {
+			return err
+		}
+		if err := f(&a); err != nil {
+			return err
+		}
+		_, err := datastore.Put(tc, k, &a)
+		return err
+	}, nil)
+}
+
+func validateLogin(login string) error {
+	if login == "" {
+		return fmt.Errorf("A login name is required")
+	}
+	if len(login) > 100 || strings.ContainsAny(login, " \t\r\n/") {
+		return fmt.Errorf("Login %q must be under 100 characters, without spaces or slashes", login)
+	}
+	return nil
+}
+
+func (a *Account) setPassword(password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return fmt.Errorf("Passwords must be %d to %d characters long", minPasswordLength, maxPasswordLength)
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	a.PasswordHash = h
+	return nil
+}
+
+// Failed logins are counted per account in memcache, where the count expires
+// after loginLockout
+func loginFailuresKey(login string) string {
+	return "login-failures." + hashSecret(login)
+}
+
+func loginFailures(c appengine.Context, login string) int {
+	item, err := memcache.Get(c, loginFailuresKey(login))
+	if err != nil {
+		return 0
+	}
+	var n int
+	fmt.Sscan(string(item.Value), &n)
+	return n
+}
+
+func recordLoginFailure(c appengine.Context, login string) {
+	key := loginFailuresKey(login)
+	memcache.Add(c, &memcache.Item{Key: key, Value: []byte("0"), Expiration: loginLockout})
+	if _, err := memcache.Increment(c, key, 1, 0); err != nil {
+		c.Warningf("Counting failed login: %v", err)
+	}
+}
+
+// checkLogin verifies a password, and if the account has two-factor login, a
+// code, which can't be used again
+func checkLogin(c appengine.Context, login, password, code string) error {
+	if loginFailures(c, login) >= maxLoginFailures {
+		return errLockedOut
+	}
+
+	a, err := getAccount(c, login)
+	if err == datastore.ErrNoSuchEntity {
+		// Take as long as a wrong password would, so logins can't be probed
+		bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		recordLoginFailure(c, login)
+		return errBadLogin
+	} else if err != nil {
+		return err
+	}
+	if bcrypt.CompareHashAndPassword(a.PasswordHash, []byte(password)) != nil {
+		recordLoginFailure(c, login)
+		return errBadLogin
+	}
+
+	if a.TOTPSecret != "" {
+		err := updateAccount(c, login, func(a *Account) error {
+			step, ok := checkTOTP(a.TOTPSecret, code, time.Now(), a.TOTPStep)
+			if !ok {
+				return errBadCode
+			}
+			a.TOTPStep = step
+			return nil
+		})
+		if err == errBadCode {
+			recordLoginFailure(c, login)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	memcache.Delete(c, loginFailuresKey(login))
+	return nil
+}
+
+// createFirstAccount sets up the blog's first account, as an administrator,
+// given the setup key
+func createFirstAccount(c appengine.Context, login, password, key string) error {
+	want := os.Getenv("DINGHY_SETUP_KEY")
+	if want == "" {
+		return errNoSetupKey
+	}
+	if loginFailures(c, setupLogin) >= maxLoginFailures {
+		return errLockedOut
+	}
+	if !hmac.Equal([]byte(key), []byte(want)) {
+		recordLoginFailure(c, setupLogin)
+		return errBadSetupKey
+	}
+
+	if err := validateLogin(login); err != nil {
+		return err
+	}
+	a := Account{Admin: true, Created: time.Now()}
+	if err := a.setPassword(password); err != nil {
+		return err
+	}
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		keys, err := datastore.NewQuery("Account").Ancestor(accountsKey(tc)).KeysOnly().Limit(1).GetAll(tc, nil)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			return errSetupDone
+		}
+		_, err = datastore.Put(tc, accountKey(tc, login), &a)
+		return err
+	}, nil)
+}
+
+// startSession logs in to an account, setting the session cookie
+func startSession(c appengine.Context, w http.ResponseWriter, login string) error {
+	secret, err := newSecret()
+	if err != nil {
+		return err
+	}
+	s := Session{Login: login, Expires: time.Now().Add(sessionLifetime)}
+	if _, err := datastore.Put(c, datastore.NewKey(c, "Session", hashSecret(secret), 0, nil), &s); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    secret,
+		Path:     "/",
+		Expires:  s.Expires,
+		Secure:   true,
+		HttpOnly: true,
+	})
+	return nil
+}
+
+// endSessions deletes every session of an account
+func endSessions(c appengine.Context, login string) error {
+	keys, err := datastore.NewQuery("Session").Filter("Login =", login).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	return datastore.DeleteMulti(c, keys)
+}
+
+// renewSessions ends every session of an account, after its password or
+// two-factor login changes, then starts a new one if it's the account making
+// the change, so that only they stay logged in
+func renewSessions(c appengine.Context, w http.ResponseWriter, login, self string) error {
+	if err := endSessions(c, login); err != nil {
+		return err
+	}
+	if login != self {
+		return nil
+	}
+	return startSession(c, w, login)
+}
+
+// The login page
+type loginForm struct {
+	// There are no accounts yet, so this creates the first
+	Setup    bool
+	Login    string
+	Continue string
+	Error    string
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(loginTemplateHTML))
+
+const loginTemplateHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<meta name="robots" content="noindex">
+	<title>{{if .Setup}}Create the first account{{else}}Log in{{end}}</title>
+	<link href="/static/bootstrap/css/bootstrap.min.css" rel="stylesheet">
+</head>
+<body>
+<div class="container" style="max-width:400px; margin-top:40px">
+	<h3>{{if .Setup}}Create the first account{{else}}Log in{{end}}</h3>
+	{{if .Setup}}<p class="help-block">This account will be the blog's administrator.</p>{{end}}
+	{{if .Error}}<div class="alert alert-danger">{{.Error}}</div>{{end}}
+	<form method="post" action="/login" role="form">
+		<input type="hidden" name="continue" value="{{.Continue}}">
+		<div class="form-group">
+			<label for="login">Login</label>
+			<input type="text" class="form-control" id="login" name="Login" value="{{.Login}}" autocomplete="username" required autofocus>
+		</div>
+		<div class="form-group">
+			<label for="password">Password</label>
+			<input type="password" class="form-control" id="password" name="Password"
+				autocomplete="{{if .Setup}}new-password{{else}}current-password{{end}}" required>
+		</div>
+		{{if .Setup}}
+		<div class="form-group">
+			<label for="setupkey">Setup key</label>
+			<input type="password" class="form-control" id="setupkey" name="SetupKey" autocomplete="off" required>
+			<p class="help-block">The DINGHY_SETUP_KEY the blog was deployed with</p>
+		</div>
+		{{else}}
+		<div class="form-group">
+			<label for="code">Two-factor code</label>
+			<input type="text" class="form-control" id="code" name="Code" inputmode="numeric"
+				autocomplete="one-time-code" placeholder="Only if two-factor login is on">
+		</div>
+		{{end}}
+		<button type="submit" class="btn btn-primary">{{if .Setup}}Create account{{else}}Log in{{end}}</button>
+	</form>
+</div>
+</body>
+</html>
+`
+
+func writeLoginForm(w http.ResponseWriter, status int, f loginForm) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := loginTemplate.Execute(w, f); err != nil {
+		fmt.Fprint(w, err.Error())
+	}
+}
+
+// login shows the login form on GET, and logs in on POST, returning to the
+// local path given as "continue". With App Engine logins, it sends users to
+// the Users service's login page instead.
+func login(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	dest := localPath(r.FormValue("continue"), "/admin")
+
+	if _, ok := auth.(localAuth); !ok {
+		u, err := auth.loginURL(c, r, dest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+
+	keys, err := datastore.NewQuery("Account").KeysOnly().Limit(1).GetAll(c, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f := loginForm{Setup: len(keys) == 0, Continue: dest}
+	if r.Method != "POST" {
+		writeLoginForm(w, http.StatusOK, f)
+		return
+	}
+
+	f.Login = strings.TrimSpace(r.FormValue("Login"))
+	password := r.FormValue("Password")
+	if f.Setup {
+		err = createFirstAccount(c, f.Login, password, r.FormValue("SetupKey"))
+	} else {
+		err = checkLogin(c, f.Login, password, r.FormValue("Code"))
+	}
+	if err != nil {
+		f.Error = err.Error()
+		writeLoginForm(w, http.StatusUnauthorized, f)
+		return
+	}
+
+	if err := startSession(c, w, f.Login); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, dest, http.StatusSeeOther)
+}
+
+// logout ends the current session, if its CSRF token is given as "csrf", then
+// goes to the local path given as "continue". With App Engine logins, it sends
+// users to the Users service to log out.
+func logout(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	dest := localPath(r.FormValue("continue"), "/")
+
+	if _, ok := auth.(localAuth); !ok {
+		u, err := auth.logoutURL(c, r, dest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+
+	if u := auth.current(c, r); u != nil {
+		want, err := csrfToken(c, u)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !hmac.Equal([]byte(r.FormValue("csrf")), []byte(want)) {
+			http.Error(w, "Missing or invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		if err := datastore.Delete(c, datastore.NewKey(c, "Session", u.ID, 0, nil)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, dest, http.StatusSeeOther)
+}
+
+// AJAX functions
+
+// accounts lists local accounts on GET: every account for owners, or just
+// their own for anyone else. On POST, the "action" form value "save" creates
+// an account with the given Login, or updates the one with the given ID,
+// changing its Password if one is given, and "delete" deletes it. "totp"
+// starts setting up two-factor login, returning a secret for an authenticator
+// app, which "totp-confirm" turns on once given a Code from the app, and
+// "totp-off" turns it off. Only owners can create, delete or change others'
+// accounts, or make administrators. Changing one's own password or two-factor
+// login also needs one's CurrentPassword, and CurrentCode if two-factor login
+// is on. A new password or two-factor login ends the account's sessions, and
+// starts a new one if it's one's own.
+func accounts(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if _, ok := auth.(localAuth); !ok {
+		http.Error(w, errNotLocal.Error(), http.StatusNotFound)
+		return
+	}
+
+	self := ""
+	if u := auth.current(c, r); u != nil {
+		self = u.Login
+	}
+	manager := allowed(c, r, permManage)
+	action := r.FormValue("action")
+	id := r.FormValue("ID")
+
+	if action != "" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if action != "" && !manager && (id == "" || id != self || action == "delete") {
+		http.Error(w, "You may only change your own account", http.StatusForbidden)
+		return
+	}
+
+	// So that a stolen session can't lock its owner out
+	reauth := action == "totp" || action == "totp-off" || (action == "save" && r.FormValue("Password") != "")
+	if id != "" && id == self && reauth {
+		if err := checkLogin(c, self, r.FormValue("CurrentPassword"), r.FormValue("CurrentCode")); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	switch action {
+	case "":
+		a := make([]Account, 0)
+		logins := make([]string, 0)
+		if manager {
+			keys, err := datastore.NewQuery("Account").GetAll(c, &a)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, k := range keys {
+				logins = append(logins, k.StringID())
+			}
+		} else if own, err := getAccount(c, self); err == nil {
+			a, logins = append(a, own), append(logins, self)
+		}
+
+		info := make([]accountInfo, len(a))
+		for i := range a {
+			info[i] = accountInfo{logins[i], a[i].Admin, a[i].TOTPSecret != "", a[i].Created}
+		}
+		j, err := json.Marshal(info)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%s", j)
+
+	case "save":
+		password := r.FormValue("Password")
+		admin := r.FormValue("Admin") != ""
+		if id == "" {
+			login := strings.TrimSpace(r.FormValue("Login"))
+			if err := validateLogin(login); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			a := Account{Admin: admin, Created: time.Now()}
+			if err := a.setPassword(password); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			k := accountKey(c, login)
+			err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+				if err := datastore.Get(tc, k, &Account{}); err == nil {
+					return fmt.Errorf("An account with login %s already exists", login)
+				} else if err != datastore.ErrNoSuchEntity {
+					return err
+				}
+				_, err := datastore.Put(tc, k, &a)
+				return err
+			}, nil)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "success")
+			return
+		}
+
+		err := updateAccount(c, id, func(a *Account) error {
+			// Administrators can't demote themselves, so there's always one left
+			if a.Admin && id == self && !admin {
+				return errSelfDemote
+			}
+			if manager {
+				a.Admin = admin
+			}
+			if password == "" {
+				return nil
+			}
+			return a.setPassword(password)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// A new password logs out everywhere else
+		if password != "" {
+			if err := renewSessions(c, w, id, self); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		fmt.Fprint(w, "success")
+
+	case "delete":
+		if id == self {
+			http.Error(w, "You can't delete your own account", http.StatusBadRequest)
+			return
+		}
+		if err := datastore.Delete(c, accountKey(c, id)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := endSessions(c, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "success")
+
+	case "totp":
+		secret, err := newTOTPSecret()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = updateAccount(c, id, func(a *Account) error {
+			a.PendingTOTP = secret
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		issuer := "dinghy"
+		if b, err := getBlogInfo(c); err == nil && b.Title != "" {
+			issuer = b.Title
+		}
+		j, err := json.Marshal(map[string]string{"Secret": secret, "URI": totpURI(issuer, id, secret)})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%s", j)
+
+	case "totp-confirm":
+		err := updateAccount(c, id, func(a *Account) error {
+			step, ok := checkTOTP(a.PendingTOTP, r.FormValue("Code"), time.Now(), 0)
+			if !ok {
+				return errBadCode
+			}
+			a.TOTPSecret, a.PendingTOTP, a.TOTPStep = a.PendingTOTP, "", step
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := renewSessions(c, w, id, self); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "success")
+
+	case "totp-off":
+		err := updateAccount(c, id, func(a *Account) error {
+			a.TOTPSecret, a.PendingTOTP, a.TOTPStep = "", "", 0
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := renewSessions(c, w, id, self); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "success")
+
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+	}
+}
@@ -46,7 +46,7 @@ var g_titles      = make(map[string]string)
 var outdent_re *regexp.Regexp
 var escaper    *strings.Replacer
 
-func markdown (lead, content string) string {
+func markdown (lead, content string, embeds []embed) string {
 	s := lead + content
 
 	outdent_re =  regexp.MustCompile( `(?m)^ {1,` + tab_width + `}` )
@@ -70,6 +70,9 @@ func markdown (lead, content string) string {
 	var re = regexp.MustCompile(`(?m)^ +$`)
 	s = re.ReplaceAllLiteralString(s, "")
 
+	// Expand links on their own line into embedded media
+	s = doEmbeds(s, embeds)
+
 	// Turn block-level HTML blocks into hash entries
 	s = hashHTMLBlocks(s);
 
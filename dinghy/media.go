@@ -0,0 +1,506 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/blobstore"
+	"appengine/datastore"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Media entity describes an uploaded file. The file itself lives in the
+// configured mediaStore, except for thumbnails, which are small enough to
+// keep in the entity.
+type Media struct {
+	Name        string
+	ContentType string `datastore:",noindex"`
+	Size        int64  `datastore:",noindex"`
+	Date        time.Time
+	BlobKey     appengine.BlobKey `datastore:",noindex" json:"-"`
+	File        string            `datastore:",noindex" json:"-"`
+	Data        []byte            `datastore:",noindex" json:"-"`
+	Thumb       []byte            `datastore:",noindex" json:"-"`
+	ID          int64             `datastore:"-"`
+	URL         string            `datastore:"-"`
+	ThumbURL    string            `datastore:"-" json:",omitempty"`
+}
+
+const (
+	// Longest edge of generated thumbnails, in pixels
+	thumbSize = 200
+	// Images larger than this many pixels are not thumbnailed
+	thumbMaxPixels = 25000000
+	// Uploads are served from stable URLs, so they can be cached forever
+	mediaCacheControl = "public, max-age=31536000"
+	// Files uploaded through the publishing APIs are kept in the Media entity
+	// itself, so must fit within the datastore's entity size limit
+	inlineMediaMax = 900 << 10
+)
+
+// Uploads are served from the blog's own origin, so only these types, which
+// can't run script, are shown in the browser; anything else is downloaded
+var inlineMediaTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+	"image/bmp":  true,
+	"video/mp4":  true,
+	"video/webm": true,
+	"video/ogg":  true,
+}
+
+var errMediaSize = errors.New("File is empty or too large, upload it from the admin page instead")
+
+// A mediaStore holds the bytes of uploaded files. On App Engine, uploads go
+// to the blobstore; standalone deployments store them on the filesystem by
+// setting DINGHY_MEDIA_DIR.
+type mediaStore interface {
+	// uploadURL returns the URL the admin page should post files to
+	uploadURL(c appengine.Context) (string, error)
+	// receive stores the files from an upload request
+	receive(c appengine.Context, r *http.Request) ([]Media, error)
+	open(c appengine.Context, m *Media) (io.ReadCloser, error)
+	serve(w http.ResponseWriter, r *http.Request, m *Media)
+	remove(c appengine.Context, m *Media) error
+}
+
+var media mediaStore = blobStore{}
+
+func init() {
+	if dir := os.Getenv("DINGHY_MEDIA_DIR"); dir != "" {
+		media = fileStore{dir: dir}
+	}
+}
+
+// Blobstore-backed storage. Uploads are posted directly to the blobstore,
+// which then calls "/upload" with the resulting blob keys.
+type blobStore struct{}
+
+func (blobStore) uploadURL(c appengine.Context) (string, error) {
+	u, err := blobstore.UploadURL(c, "/upload", nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (blobStore) receive(c appengine.Context, r *http.Request) ([]Media, error) {
+	blobs, _, err := blobstore.ParseUpload(r)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make([]Media, 0)
+	for _, info := range blobs["file"] {
+		m = append(m, Media{
+			Name:        info.Filename,
+			ContentType: info.ContentType,
+			Size:        info.Size,
+			Date:        info.CreationTime,
+			BlobKey:     info.BlobKey,
+		})
+	}
+	return m, nil
+}
+
+func (blobStore) open(c appengine.Context, m *Media) (io.ReadCloser, error) {
+	if m.BlobKey == "" {
+		return ioutil.NopCloser(bytes.NewReader(m.Data)), nil
+	}
+	return ioutil.NopCloser(blobstore.NewReader(c, m.BlobKey)), nil
+}
+
+func (blobStore) serve(w http.ResponseWriter, r *http.Request, m *Media) {
+	if m.BlobKey == "" {
+		w.Write(m.Data)
+		return
+	}
+	blobstore.Send(w, m.BlobKey)
+}
+
+func (blobStore) remove(c appengine.Context, m *Media) error {
+	if m.BlobKey == "" {
+		return nil
+	}
+	return blobstore.Delete(c, m.BlobKey)
+}
+
+// Filesystem-backed storage, for deployments outside App Engine
+type fileStore struct {
+	dir string
+}
+
+func (fileStore) uploadURL(c appengine.Context) (string, error) {
+	return "/upload", nil
+}
+
+func (s fileStore) receive(c appengine.Context, r *http.Request) ([]Media, error) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		return nil, err
+	}
+
+	m := make([]Media, 0)
+	for _, fh := range r.MultipartForm.File["file"] {
+		name, size, err := s.save(fh)
+		if err != nil {
+			return m, err
+		}
+		m = append(m, Media{
+			Name:        fh.Filename,
+			ContentType: fh.Header.Get("Content-Type"),
+			Size:        size,
+			Date:        time.Now(),
+			File:        name,
+		})
+	}
+	return m, nil
+}
+
+// save copies an uploaded file into the media directory under a random name
+func (s fileStore) save(fh *multipart.FileHeader) (string, int64, error) {
+	src, err := fh.Open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", 0, err
+	}
+	name := hex.EncodeToString(b) + strings.ToLower(filepath.Ext(fh.Filename))
+
+	dst, err := os.Create(filepath.Join(s.dir, name))
+	if err != nil {
+		return "", 0, err
+	}
+	defer dst.Close()
+
+	size, err := io.Copy(dst, src)
+	return name, size, err
+}
+
+func (s fileStore) open(c appengine.Context, m *Media) (io.ReadCloser, error) {
+	if m.File == "" {
+		return ioutil.NopCloser(bytes.NewReader(m.Data)), nil
+	}
+	return os.Open(filepath.Join(s.dir, m.File))
+}
+
+func (s fileStore) serve(w http.ResponseWriter, r *http.Request, m *Media) {
+	if m.File == "" {
+		w.Write(m.Data)
+		return
+	}
+	f, err := os.Open(filepath.Join(s.dir, m.File))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	http.ServeContent(w, r, "", m.Date, f)
+}
+
+func (s fileStore) remove(c appengine.Context, m *Media) error {
+	if m.File == "" {
+		return nil
+	}
+	err := os.Remove(filepath.Join(s.dir, m.File))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// putMedia generates a thumbnail for image uploads, and saves the Media entity
+func putMedia(c appengine.Context, m *Media) error {
+	if strings.HasPrefix(m.ContentType, "image/") {
+		if err := makeThumb(c, m); err != nil {
+			c.Warningf("No thumbnail for %s: %v", m.Name, err)
+		}
+	}
+
+	k := datastore.NewIncompleteKey(c, "Media", nil)
+	k, err := datastore.Put(c, k, m)
+	if err != nil {
+		return err
+	}
+	m.ID = k.IntID()
+	m.setURLs()
+	return nil
+}
+
+// putInlineMedia saves a file received in a request body, rather than through
+// the mediaStore
+func putInlineMedia(c appengine.Context, name, contentType string, data []byte) (Media, error) {
+	m := Media{
+		Name:        name,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Date:        time.Now(),
+		Data:        data,
+	}
+	if len(data) == 0 || len(data) > inlineMediaMax {
+		return m, errMediaSize
+	}
+	if m.ContentType == "" || m.ContentType == "application/octet-stream" {
+		m.ContentType = http.DetectContentType(data)
+	}
+	return m, putMedia(c, &m)
+}
+
+func (m *Media) setURLs() {
+	m.URL = "/media/" + strconv.FormatInt(m.ID, 10)
+	if len(m.Thumb) > 0 {
+		m.ThumbURL = m.URL + "/thumb"
+	}
+}
+
+// makeThumb scales an image down to fit within thumbSize pixels, using a box
+// filter, and stores the result as a JPEG, or as a PNG for formats that may
+// have transparency.
+func makeThumb(c appengine.Context, m *Media) error {
+	rc, err := media.open(c, m)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if cfg.Width*cfg.Height > thumbMaxPixels {
+		return fmt.Errorf("image is too large (%dx%d)", cfg.Width, cfg.Height)
+	}
+
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	dst := resize(src, thumbSize)
+	var buffer bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buffer, dst, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buffer, dst)
+	}
+	if err != nil {
+		return err
+	}
+
+	m.Thumb = buffer.Bytes()
+	return nil
+}
+
+// resize returns img scaled so its longest edge is at most max pixels. Each
+// destination pixel is the average of the source pixels it covers.
+func resize(img image.Image, max int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= max && h <= max {
+		return img
+	}
+
+	dw, dh := max, h*max/w
+	if h > w {
+		dw, dh = w*max/h, max
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, (y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, (x+1)*w/dw
+			var r, g, bl, a, n int
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(src.Pix[i])
+					g += int(src.Pix[i+1])
+					bl += int(src.Pix[i+2])
+					a += int(src.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(bl / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+func getMedia(id int64, c appengine.Context) (Media, error) {
+	m := Media{}
+	k := datastore.NewKey(c, "Media", "", id, nil)
+	if err := datastore.Get(c, k, &m); err != nil {
+		return m, err
+	}
+	m.ID = id
+	m.setURLs()
+	return m, nil
+}
+
+// removeMedia deletes a Media entity and its stored file
+func removeMedia(c appengine.Context, m *Media) error {
+	if err := media.remove(c, m); err != nil {
+		return err
+	}
+	return datastore.Delete(c, datastore.NewKey(c, "Media", "", m.ID, nil))
+}
+
+// serveMedia handles "/media/{id}" and "/media/{id}/thumb"
+func serveMedia(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	path := strings.TrimPrefix(r.URL.Path, "/media/")
+	thumb := strings.HasSuffix(path, "/thumb")
+	path = strings.TrimSuffix(path, "/thumb")
+
+	id, err := strconv.ParseInt(path, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	m, err := getMedia(id, c)
+	if err == datastore.ErrNoSuchEntity {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", mediaCacheControl)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if thumb {
+		if len(m.Thumb) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(m.Thumb))
+		w.Write(m.Thumb)
+		return
+	}
+
+	ct, disposition := "application/octet-stream", "attachment"
+	if m.ContentType != "" {
+		ct = m.ContentType
+	}
+	if t, _, err := mime.ParseMediaType(ct); err == nil && inlineMediaTypes[t] {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Disposition", disposition+`; filename="`+strings.Replace(m.Name, `"`, "", -1)+`"`)
+	media.serve(w, r, &m)
+}
+
+// AJAX functions
+
+// upload returns the URL to post files to on GET. Posted files are stored,
+// and the new Media entities are returned as JSON.
+func upload(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if r.Method != "POST" {
+		u, err := media.uploadURL(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, u)
+		return
+	}
+
+	m, err := media.receive(c, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := range m {
+		if err := putMedia(c, &m[i]); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	j, err := json.Marshal(m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "%s", j)
+}
+
+// listMedia returns the most recent uploads as JSON, for the admin picker
+func listMedia(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	m := make([]Media, 0)
+
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	q := datastore.NewQuery("Media").Order("-Date").Offset(offset).Limit(60)
+	keys, err := q.GetAll(c, &m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := range m {
+		m[i].ID = keys[i].IntID()
+		m[i].setURLs()
+	}
+
+	j, err := json.Marshal(m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "%s", j)
+}
@@ -0,0 +1,172 @@
+package dinghy
+
+import (
+	"appengine"
+	"encoding/json"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ *  Link preview metadata: OpenGraph (https://ogp.me/) and Twitter Card meta
+ *  tags, and a schema.org BlogPosting in JSON-LD, so links shared on social
+ *  sites and in chat render with a title, summary and picture. Templates
+ *  include it with {{metadata .}} in their head. A post is described by its
+ *  title, description, dates, tags and first image; other pages by the blog's
+ *  own title and description.
+ */
+
+var imgTagRe = regexp.MustCompile(`(?is)<img\b[^>]*>`)
+
+var srcAttrRe = attrRe("src")
+
+// A metaTag is a <meta> element, named by property for OpenGraph and by name
+// for Twitter
+type metaTag struct {
+	attr    string
+	name    string
+	content string
+}
+
+// blogPosting is the schema.org JSON-LD description of a post
+type blogPosting struct {
+	Context          string       `json:"@context"`
+	Type             string       `json:"@type"`
+	Headline         string       `json:"headline"`
+	Description      string       `json:"description,omitempty"`
+	Image            string       `json:"image,omitempty"`
+	DatePublished    string       `json:"datePublished"`
+	DateModified     string       `json:"dateModified"`
+	Author           schemaPerson `json:"author"`
+	Keywords         string       `json:"keywords,omitempty"`
+	URL              string       `json:"url"`
+	MainEntityOfPage string       `json:"mainEntityOfPage"`
+}
+
+type schemaPerson struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+// metadata renders the link preview tags for a page. A single post that
+// readers can see is an article; anything else describes the blog.
+func metadata(b Blog, c appengine.Context) (string, error) {
+	base := siteURL(b, c)
+	author := b.Author
+	if author == "" {
+		author = b.Title
+	}
+
+	if !b.Single || len(b.Posts) != 1 || b.Posts[0].ID == 0 {
+		return renderMetadata([]metaTag{
+			{"property", "og:type", "website"},
+			{"property", "og:site_name", b.Title},
+			{"property", "og:title", b.Title},
+			{"property", "og:description", b.Description},
+			{"property", "og:url", base + "/"},
+			{"name", "twitter:card", "summary"},
+			{"name", "twitter:title", b.Title},
+			{"name", "twitter:description", b.Description},
+		}, nil)
+	}
+
+	p := b.Posts[0]
+	if p.Author != nil {
+		author = p.Author.Name
+	}
+	link := base + "/" + strconv.FormatInt(p.ID, 10)
+	description := p.Description
+	if description == "" {
+		description = b.Description
+	}
+	image := firstImage(p.Lead, p.Content, base, blogEmbeds(b.Embeds))
+	modified := newestPost([]Post{p})
+
+	card := "summary"
+	if image != "" {
+		card = "summary_large_image"
+	}
+	tags := []metaTag{
+		{"property", "og:type", "article"},
+		{"property", "og:site_name", b.Title},
+		{"property", "og:title", p.Title},
+		{"property", "og:description", description},
+		{"property", "og:url", link},
+		{"property", "og:image", image},
+		{"property", "article:published_time", p.Date.UTC().Format(time.RFC3339)},
+		{"property", "article:modified_time", modified.UTC().Format(time.RFC3339)},
+		{"property", "article:author", author},
+	}
+	for _, t := range p.Tags {
+		tags = append(tags, metaTag{"property", "article:tag", t})
+	}
+	tags = append(tags,
+		metaTag{"name", "twitter:card", card},
+		metaTag{"name", "twitter:title", p.Title},
+		metaTag{"name", "twitter:description", description},
+		metaTag{"name", "twitter:image", image})
+
+	return renderMetadata(tags, &blogPosting{
+		Context:          "https://schema.org",
+		Type:             "BlogPosting",
+		Headline:         p.Title,
+		Description:      description,
+		Image:            image,
+		DatePublished:    p.Date.UTC().Format(time.RFC3339),
+		DateModified:     modified.UTC().Format(time.RFC3339),
+		Author:           schemaPerson{"Person", author},
+		Keywords:         strings.Join(p.Tags, ", "),
+		URL:              link,
+		MainEntityOfPage: link,
+	})
+}
+
+// renderMetadata writes the tags with content, a canonical link for articles,
+// and the JSON-LD if there is any
+func renderMetadata(tags []metaTag, ld *blogPosting) (string, error) {
+	lines := make([]string, 0, len(tags)+2)
+	for _, t := range tags {
+		if t.content == "" {
+			continue
+		}
+		lines = append(lines, `<meta `+t.attr+`="`+t.name+`" content="`+html.EscapeString(t.content)+`">`)
+	}
+	if ld == nil {
+		return strings.Join(lines, "\n"), nil
+	}
+
+	// The encoder escapes <, > and &, so the JSON can't close the script
+	j, err := json.Marshal(ld)
+	if err != nil {
+		return "", err
+	}
+	lines = append(lines,
+		`<link rel="canonical" href="`+html.EscapeString(ld.URL)+`">`,
+		`<script type="application/ld+json">`+string(j)+`</script>`)
+	return strings.Join(lines, "\n"), nil
+}
+
+// firstImage returns the absolute address of the first image in a post's
+// HTML, including images from embeds, or blank if it has none
+func firstImage(lead, content, base string, embeds []embed) string {
+	for _, tag := range imgTagRe.FindAllString(markdown(lead, content, embeds), -1) {
+		src, ok := attr(tag, srcAttrRe)
+		if !ok || src == "" || strings.HasPrefix(src, "data:") {
+			continue
+		}
+		b, err := url.Parse(base + "/")
+		if err != nil {
+			return ""
+		}
+		u, err := b.Parse(src)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		return u.String()
+	}
+	return ""
+}
@@ -0,0 +1,529 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ *  Micropub (https://www.w3.org/TR/micropub/) lets IndieWeb clients create,
+ *  update and delete h-entry posts. Requests authenticate with an API token,
+ *  sent as a bearer token or as the "access_token" form field. Queries need
+ *  read scope, and changes need write scope.
+ *
+ *  h-entry properties map onto Post fields: name is the Title, summary the
+ *  Description, content the markdown body (split into Lead and Content),
+ *  category the Tags, and published the Date. A post-status of "draft" hides
+ *  the post. Photos are appended to the content as bare links on their own
+ *  lines, which the embed providers turn into images.
+ */
+
+// Properties of an h-entry. Every value is a list, as in microformats2 JSON.
+type mfProperties map[string][]interface{}
+
+type mfEntry struct {
+	Type       []string     `json:"type"`
+	Properties mfProperties `json:"properties"`
+}
+
+// A Micropub request in JSON. Updates use Replace, Add and Delete; Delete may
+// be a list of property names, or properties with values to remove.
+type micropubRequest struct {
+	mfEntry
+	Action  string       `json:"action"`
+	URL     string       `json:"url"`
+	Replace mfProperties `json:"replace"`
+	Add     mfProperties `json:"add"`
+	Delete  interface{}  `json:"delete"`
+}
+
+type micropubError struct {
+	Status      int    `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *micropubError) Error() string {
+	return e.Description
+}
+
+func mpError(status int, code, desc string) *micropubError {
+	return &micropubError{status, code, desc}
+}
+
+// Form fields that are part of the request, rather than post properties
+var micropubReserved = map[string]bool{"h": true, "action": true, "url": true, "access_token": true}
+
+// micropub handles "/micropub"
+func micropub(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	var err error
+	switch r.Method {
+	case "GET":
+		err = micropubQuery(w, r, c)
+	case "POST":
+		err = micropubPost(w, r, c)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		err = mpError(http.StatusMethodNotAllowed, "invalid_request", r.Method+" is not supported")
+	}
+
+	if err != nil {
+		writeMicropubError(w, err, c)
+	}
+}
+
+func writeMicropubError(w http.ResponseWriter, err error, c appengine.Context) {
+	e, ok := err.(*micropubError)
+	if !ok {
+		c.Errorf("micropub: %v", err)
+		e = mpError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+	j, _ := json.Marshal(e)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	fmt.Fprintf(w, "%s", j)
+}
+
+// micropubToken returns the request's token, which Micropub also allows as
+// an access_token form value
+func micropubToken(c appengine.Context, r *http.Request) (*Token, error) {
+	t, err := requestToken(c, r)
+	if err == errNoToken {
+		if secret := r.FormValue("access_token"); secret != "" {
+			t, err = lookupToken(c, secret)
+		}
+	}
+	return t, err
+}
+
+// micropubAuth returns the caller acting with the request's token, if their
+// role has the given permission
+func micropubAuth(c appengine.Context, r *http.Request, perm permission) (caller, error) {
+	t, err := micropubToken(c, r)
+	switch {
+	case err == errNoToken:
+		return caller{}, mpError(http.StatusUnauthorized, "unauthorized", "No access token was provided")
+	case err != nil:
+		return caller{}, mpError(http.StatusForbidden, "forbidden", "Invalid access token")
+	}
+	cl := tokenCaller(c, t)
+	if !cl.can(perm) {
+		return cl, mpError(http.StatusUnauthorized, "insufficient_scope", "This token does not have permission to "+perm.String())
+	}
+	return cl, nil
+}
+
+func micropubJSON(w http.ResponseWriter, v interface{}) error {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", j)
+	return nil
+}
+
+func micropubQuery(w http.ResponseWriter, r *http.Request, c appengine.Context) error {
+	if _, err := micropubAuth(c, r, permRead); err != nil {
+		return err
+	}
+
+	switch r.FormValue("q") {
+	case "config":
+		base, err := blogURL(c)
+		if err != nil {
+			return err
+		}
+		return micropubJSON(w, map[string]interface{}{
+			"media-endpoint": base + "/micropub/media",
+			"syndicate-to":   []string{},
+			"post-types": []map[string]string{
+				{"type": "note", "name": "Note"},
+				{"type": "article", "name": "Article"},
+				{"type": "photo", "name": "Photo"},
+			},
+		})
+
+	case "syndicate-to":
+		return micropubJSON(w, map[string]interface{}{"syndicate-to": []string{}})
+
+	case "source":
+		id, err := micropubPostID(r.FormValue("url"))
+		if err != nil {
+			return err
+		}
+		p := Post{}
+		if err := datastore.Get(c, datastore.NewKey(c, "Post", "", id, nil), &p); err == datastore.ErrNoSuchEntity {
+			return mpError(http.StatusBadRequest, "invalid_request", "No such post")
+		} else if err != nil {
+			return err
+		}
+
+		props := postProperties(&p)
+		r.ParseForm()
+		if want := append(r.Form["properties[]"], r.Form["properties"]...); len(want) > 0 {
+			only := mfProperties{}
+			for _, name := range want {
+				if v, ok := props[name]; ok {
+					only[name] = v
+				}
+			}
+			return micropubJSON(w, map[string]interface{}{"properties": only})
+		}
+		return micropubJSON(w, mfEntry{Type: []string{"h-entry"}, Properties: props})
+	}
+
+	return mpError(http.StatusBadRequest, "invalid_request", "Unsupported query")
+}
+
+func micropubPost(w http.ResponseWriter, r *http.Request, c appengine.Context) error {
+	req := micropubRequest{}
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if ct == "application/json" {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			return mpError(http.StatusBadRequest, "invalid_request", err.Error())
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return mpError(http.StatusBadRequest, "invalid_request", "Malformed JSON: "+err.Error())
+		}
+	} else {
+		if err := r.ParseMultipartForm(2 * inlineMediaMax); err != nil && err != http.ErrNotMultipart {
+			return mpError(http.StatusBadRequest, "invalid_request", err.Error())
+		}
+		req.Action = r.FormValue("action")
+		req.URL = r.FormValue("url")
+		if h := r.FormValue("h"); h != "" {
+			req.Type = []string{"h-" + h}
+		}
+		req.Properties = mfProperties{}
+		for name, values := range r.Form {
+			name = strings.TrimSuffix(name, "[]")
+			if micropubReserved[name] {
+				continue
+			}
+			for _, v := range values {
+				req.Properties[name] = append(req.Properties[name], v)
+			}
+		}
+	}
+
+	cl, err := micropubAuth(c, r, permDraft)
+	if err != nil {
+		return err
+	}
+
+	switch req.Action {
+	case "":
+		return micropubCreate(w, r, &req, cl, c)
+	case "update":
+		return micropubUpdate(w, r, &req, cl, c)
+	case "delete":
+		id, err := micropubPostID(req.URL)
+		if err != nil {
+			return err
+		}
+		p := Post{}
+		if err := datastore.Get(c, datastore.NewKey(c, "Post", "", id, nil), &p); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err := cl.canDelete(&p); err != nil {
+			return mpError(http.StatusForbidden, "forbidden", err.Error())
+		}
+		if err := memcache.Flush(c); err != nil {
+			return err
+		}
+		if err := removePost(c, id); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	return mpError(http.StatusBadRequest, "invalid_request", "Unsupported action: "+req.Action)
+}
+
+func micropubCreate(w http.ResponseWriter, r *http.Request, req *micropubRequest, cl caller, c appengine.Context) error {
+	if len(req.Type) > 0 && req.Type[0] != "h-entry" {
+		return mpError(http.StatusBadRequest, "invalid_request", "Only h-entry posts are supported")
+	}
+
+	base, err := blogURL(c)
+	if err != nil {
+		return err
+	}
+
+	// Uploaded photos are stored, and linked like photo URLs
+	if r.MultipartForm != nil {
+		for _, name := range []string{"photo", "photo[]"} {
+			for _, fh := range r.MultipartForm.File[name] {
+				if !cl.can(permUpload) {
+					return mpError(http.StatusForbidden, "forbidden", "This token does not have permission to "+permUpload.String())
+				}
+				m, err := micropubFile(c, fh)
+				if err != nil {
+					return err
+				}
+				req.Properties["photo"] = append(req.Properties["photo"], base+m.URL)
+			}
+		}
+	}
+
+	p := Post{AuthorID: cl.AuthorID}
+	if err := applyProperties(req.Properties, &p); err != nil {
+		return err
+	}
+	if err := cl.canSave(nil, &p); err != nil {
+		return mpError(http.StatusForbidden, "forbidden", err.Error())
+	}
+	k, err := savePost(c, datastore.NewIncompleteKey(c, "Post", nil), &p)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Location", base+"/"+strconv.FormatInt(k.IntID(), 10))
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func micropubUpdate(w http.ResponseWriter, r *http.Request, req *micropubRequest, cl caller, c appengine.Context) error {
+	id, err := micropubPostID(req.URL)
+	if err != nil {
+		return err
+	}
+
+	k := datastore.NewKey(c, "Post", "", id, nil)
+	p := Post{}
+	if err := datastore.Get(c, k, &p); err == datastore.ErrNoSuchEntity {
+		return mpError(http.StatusBadRequest, "invalid_request", "No such post")
+	} else if err != nil {
+		return err
+	}
+
+	old := p
+	props := postProperties(&p)
+	for name, v := range req.Replace {
+		props[name] = v
+	}
+	for name, v := range req.Add {
+		props[name] = append(props[name], v...)
+	}
+	switch d := req.Delete.(type) {
+	case []interface{}:
+		for _, name := range d {
+			if name, ok := name.(string); ok {
+				delete(props, name)
+			}
+		}
+	case map[string]interface{}:
+		for name, remove := range d {
+			values, _ := remove.([]interface{})
+			props[name] = withoutValues(props[name], values)
+		}
+	case nil:
+	default:
+		return mpError(http.StatusBadRequest, "invalid_request", "delete must be a list or an object")
+	}
+
+	if err := applyProperties(props, &p); err != nil {
+		return err
+	}
+	if err := cl.canSave(&old, &p); err != nil {
+		return mpError(http.StatusForbidden, "forbidden", err.Error())
+	}
+	if _, err := savePost(c, k, &p); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func withoutValues(values, remove []interface{}) []interface{} {
+	kept := make([]interface{}, 0, len(values))
+outer:
+	for _, v := range values {
+		for _, r := range remove {
+			if mfString(v) == mfString(r) {
+				continue outer
+			}
+		}
+		kept = append(kept, v)
+	}
+	return kept
+}
+
+// micropubPostID finds the post ID in a post's URL, "{base URL}/{id}"
+func micropubPostID(u string) (int64, error) {
+	parsed, err := url.Parse(u)
+	if err == nil {
+		id, err := strconv.ParseInt(path.Base(parsed.Path), 10, 64)
+		if err == nil {
+			return id, nil
+		}
+	}
+	return 0, mpError(http.StatusBadRequest, "invalid_request", "Not a post URL: "+u)
+}
+
+// postProperties returns a post as h-entry properties
+func postProperties(p *Post) mfProperties {
+	props := mfProperties{
+		"content":   {p.Lead + p.Content},
+		"published": {p.Date.Format(time.RFC3339)},
+	}
+	if p.Title != "" {
+		props["name"] = []interface{}{p.Title}
+	}
+	if p.Description != "" {
+		props["summary"] = []interface{}{p.Description}
+	}
+	for _, t := range p.Tags {
+		props["category"] = append(props["category"], t)
+	}
+	if p.Hidden {
+		props["post-status"] = []interface{}{"draft"}
+	} else {
+		props["post-status"] = []interface{}{"published"}
+	}
+	return props
+}
+
+// applyProperties sets a post's fields from h-entry properties. Missing
+// properties clear their fields, except published, which keeps the post's
+// date, or sets the current time for new posts.
+func applyProperties(props mfProperties, p *Post) error {
+	p.Title = firstString(props["name"])
+	p.Description = firstString(props["summary"])
+
+	content := firstString(props["content"])
+	for _, photo := range props["photo"] {
+		// Photos with alt text arrive as {"value": url, "alt": text}
+		if u := mfString(photo); u != "" && !strings.Contains(content, u) {
+			content = strings.TrimRight(content, "\n") + "\n\n" + u + "\n"
+		}
+	}
+	p.Lead, p.Content = splitLead(strings.TrimLeft(content, "\n"))
+
+	tags := make([]string, 0, len(props["category"]))
+	for _, t := range props["category"] {
+		tags = append(tags, mfString(t))
+	}
+	p.Tags = cleanTags(tags)
+
+	if published := firstString(props["published"]); published != "" {
+		d, err := time.Parse(time.RFC3339, published)
+		if err != nil {
+			return mpError(http.StatusBadRequest, "invalid_request", "published must be an RFC 3339 date")
+		}
+		p.Date = d
+	}
+	if p.Date.IsZero() {
+		p.Date = time.Now()
+	}
+
+	switch status := firstString(props["post-status"]); status {
+	case "draft":
+		p.Hidden = true
+	case "", "published":
+		p.Hidden = false
+	default:
+		return mpError(http.StatusBadRequest, "invalid_request", "Unknown post-status: "+status)
+	}
+	return nil
+}
+
+func firstString(values []interface{}) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return mfString(values[0])
+}
+
+// mfString returns a property value's text. Content may be an object with an
+// "html" or "value" member, and photos an object with a "value" URL.
+func mfString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		for _, key := range []string{"html", "value"} {
+			if s, ok := v[key].(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// micropubMedia handles "/micropub/media", the Micropub media endpoint. The
+// file is posted as "file", and its URL returned in the Location header.
+func micropubMedia(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if err := micropubUpload(w, r, c); err != nil {
+		writeMicropubError(w, err, c)
+	}
+}
+
+func micropubUpload(w http.ResponseWriter, r *http.Request, c appengine.Context) error {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		return mpError(http.StatusMethodNotAllowed, "invalid_request", r.Method+" is not supported")
+	}
+	if err := r.ParseMultipartForm(2 * inlineMediaMax); err != nil {
+		return mpError(http.StatusBadRequest, "invalid_request", err.Error())
+	}
+	if _, err := micropubAuth(c, r, permUpload); err != nil {
+		return err
+	}
+
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		return mpError(http.StatusBadRequest, "invalid_request", "No file was uploaded")
+	}
+	m, err := micropubFile(c, files[0])
+	if err != nil {
+		return err
+	}
+	base, err := blogURL(c)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Location", base+m.URL)
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// micropubFile stores a file uploaded with a Micropub request
+func micropubFile(c appengine.Context, fh *multipart.FileHeader) (Media, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return Media{}, err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, inlineMediaMax+1))
+	if err != nil {
+		return Media{}, err
+	}
+	m, err := putInlineMedia(c, fh.Filename, fh.Header.Get("Content-Type"), data)
+	if err == errMediaSize {
+		return m, mpError(http.StatusRequestEntityTooLarge, "invalid_request", err.Error())
+	}
+	return m, err
+}
@@ -0,0 +1,54 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A Redirect sends requests for an old URL, such as the permalink of an
+// imported post, to its new one. The key name is the old path, including any
+// query string, without a trailing slash.
+type Redirect struct {
+	Target string `datastore:",noindex"`
+}
+
+// redirectPath returns the Redirect key name for a URL
+func redirectPath(u *url.URL) string {
+	p := strings.TrimSuffix(u.Path, "/")
+	if p == "" {
+		p = "/"
+	}
+	if u.RawQuery != "" {
+		p += "?" + u.RawQuery
+	}
+	return p
+}
+
+func getRedirect(c appengine.Context, path string) (string, error) {
+	rd := Redirect{}
+	k := datastore.NewKey(c, "Redirect", path, 0, nil)
+	err := datastore.Get(c, k, &rd)
+	return rd.Target, err
+}
+
+func putRedirect(c appengine.Context, path, target string) error {
+	k := datastore.NewKey(c, "Redirect", path, 0, nil)
+	_, err := datastore.Put(c, k, &Redirect{Target: target})
+	return err
+}
+
+// redirect sends a permanent redirect if the request is for a known old URL
+func redirect(w http.ResponseWriter, r *http.Request, c appengine.Context) bool {
+	target, err := getRedirect(c, redirectPath(r.URL))
+	if err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			c.Warningf("Looking up redirect: %v", err)
+		}
+		return false
+	}
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+	return true
+}
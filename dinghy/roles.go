@@ -0,0 +1,247 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"net/http"
+)
+
+/*
+ *  Roles. Whoever makes a request acts in one of these roles, which grants the
+ *  permissions in rolePermissions:
+ *
+ *  - owner: everything, including the blog's settings and template, caches,
+ *    API tokens, authors, imports and backups
+ *  - editor: writes, publishes and deletes anyone's posts, moderates comments
+ *    and rebuilds the search index
+ *  - author: writes, publishes and deletes their own posts, and uploads media
+ *  - contributor: writes drafts of their own posts, for an editor to publish
+ *  - reader: sees drafts and settings, but changes nothing
+ *
+ *  Administrators are always owners. Other logins (see auth.go) take the Role
+ *  of the author whose Login they are, and have none if there isn't one. API
+ *  tokens act as readers with the read scope, editors with write and owners
+ *  with admin, but no more than the Role of the author whose Login is the
+ *  token's name.
+ */
+
+const (
+	roleReader      = "reader"
+	roleContributor = "contributor"
+	roleAuthor      = "author"
+	roleEditor      = "editor"
+	roleOwner       = "owner"
+)
+
+var roleRank = map[string]int{roleReader: 1, roleContributor: 2, roleAuthor: 3, roleEditor: 4, roleOwner: 5}
+
+// Authors without a Role are authors
+const defaultRole = roleAuthor
+
+// A permission is something a handler lets a role do
+type permission int
+
+const (
+	permRead     permission = iota // See drafts, settings and media
+	permDraft                      // Save drafts of one's own posts
+	permPublish                    // Publish one's own posts
+	permUpload                     // Upload media
+	permEditAny                    // Save, publish and delete anyone's posts
+	permModerate                   // See and moderate comments, and rebuild the search index
+	permManage                     // Settings, template, caches, tokens, authors, imports and backups
+)
+
+var permissionNames = map[permission]string{
+	permRead:     "read",
+	permDraft:    "write posts",
+	permPublish:  "publish posts",
+	permUpload:   "upload media",
+	permEditAny:  "edit others' posts",
+	permModerate: "moderate",
+	permManage:   "manage the blog",
+}
+
+func (p permission) String() string {
+	return permissionNames[p]
+}
+
+var rolePermissions = map[string][]permission{
+	roleReader:      {permRead},
+	roleContributor: {permRead, permDraft},
+	roleAuthor:      {permRead, permDraft, permPublish, permUpload},
+	roleEditor:      {permRead, permDraft, permPublish, permUpload, permEditAny, permModerate},
+	roleOwner:       {permRead, permDraft, permPublish, permUpload, permEditAny, permModerate, permManage},
+}
+
+// The role each token scope acts in
+var scopeRoles = map[string]string{scopeRead: roleReader, scopeWrite: roleEditor, scopeAdmin: roleOwner}
+
+// A caller is whoever made a request, by their role and the author they post
+// as. A caller with no Role may do nothing. Authenticated callers are known,
+// whether or not they have a role, so are refused rather than asked to log in.
+type caller struct {
+	Role          string
+	AuthorID      string
+	Authenticated bool
+	// Why an authenticated caller was turned away, if not for their role
+	Refusal string
+}
+
+func (cl caller) can(perm permission) bool {
+	for _, p := range rolePermissions[cl.Role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// refusal explains why the caller may not do something
+func (cl caller) refusal(perm permission) string {
+	if cl.Refusal != "" {
+		return cl.Refusal
+	}
+	return "You do not have permission to " + perm.String()
+}
+
+// owns reports whether a post is attributed to the caller
+func (cl caller) owns(p *Post) bool {
+	return cl.AuthorID != "" && p.AuthorID == cl.AuthorID
+}
+
+// canSave checks the caller may save p over old, or create it if old is nil
+func (cl caller) canSave(old, p *Post) error {
+	if !cl.can(permDraft) {
+		return fmt.Errorf("You do not have permission to write posts")
+	}
+	if old != nil && !cl.owns(old) && !cl.can(permEditAny) {
+		return fmt.Errorf("You may only edit your own posts")
+	}
+	if (!p.Hidden || (old != nil && !old.Hidden)) && !cl.can(permPublish) {
+		return fmt.Errorf("You may only save drafts, for an editor to publish")
+	}
+	return nil
+}
+
+// canDelete checks the caller may delete a post. Contributors may delete
+// their own drafts.
+func (cl caller) canDelete(p *Post) error {
+	if cl.can(permEditAny) {
+		return nil
+	}
+	if !cl.owns(p) {
+		return fmt.Errorf("You may only delete your own posts")
+	}
+	if !cl.can(permPublish) && !(p.Hidden && cl.can(permDraft)) {
+		return fmt.Errorf("You may only delete your own drafts")
+	}
+	return nil
+}
+
+// lesserRole returns whichever role has fewer permissions
+func lesserRole(a, b string) string {
+	if roleRank[a] < roleRank[b] {
+		return a
+	}
+	return b
+}
+
+// loginProfile returns the author with the given login, or nil if there isn't
+// one
+func loginProfile(c appengine.Context, login string) *AuthorProfile {
+	if login == "" {
+		return nil
+	}
+	a := make([]AuthorProfile, 0, 1)
+	keys, err := datastore.NewQuery("Author").Filter("Login =", login).Limit(1).GetAll(c, &a)
+	if err != nil {
+		c.Warningf("Finding author for %s: %v", login, err)
+		return nil
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	a[0].ID = keys[0].StringID()
+	return &a[0]
+}
+
+// requestCaller works out who made a request: a login takes precedence over
+// a token
+func requestCaller(c appengine.Context, r *http.Request) caller {
+	cl := caller{}
+	if u := auth.current(c, r); u != nil {
+		if cl = loginCaller(c, u); cl.Role != "" {
+			if validCSRF(c, r, u) {
+				return cl
+			}
+			cl = caller{Authenticated: true, Refusal: "Missing or invalid CSRF token"}
+		}
+	}
+
+	t, err := requestToken(c, r)
+	if err == errNoToken {
+		return cl
+	} else if err != nil {
+		return caller{Authenticated: true}
+	}
+	return tokenCaller(c, t)
+}
+
+// loginCaller returns the caller acting with a login
+func loginCaller(c appengine.Context, u *authUser) caller {
+	cl := caller{Authenticated: true}
+	if a := loginProfile(c, u.Login); a != nil {
+		cl.Role, cl.AuthorID = a.role(), a.ID
+	}
+	if u.Admin {
+		cl.Role = roleOwner
+	}
+	return cl
+}
+
+// tokenCaller returns the caller acting with a token
+func tokenCaller(c appengine.Context, t *Token) caller {
+	cl := caller{Authenticated: true}
+	if t.Revoked {
+		return cl
+	}
+	for _, s := range t.Scopes {
+		if roleRank[scopeRoles[s]] > roleRank[cl.Role] {
+			cl.Role = scopeRoles[s]
+		}
+	}
+	if a := loginProfile(c, t.Name); a != nil {
+		cl.Role, cl.AuthorID = lesserRole(cl.Role, a.role()), a.ID
+	}
+	return cl
+}
+
+// allowed reports whether a request has the given permission
+func allowed(c appengine.Context, r *http.Request, perm permission) bool {
+	return requestCaller(c, r).can(perm)
+}
+
+// isAdmin reports whether a request may see hidden posts
+func isAdmin(c appengine.Context, r *http.Request) bool {
+	return allowed(c, r, permRead)
+}
+
+// authorize wraps a handler, so that it's only reachable with the given
+// permission
+func authorize(perm permission, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cl := requestCaller(appengine.NewContext(r), r)
+		if cl.can(perm) {
+			h(w, r)
+			return
+		}
+
+		if !cl.Authenticated {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dinghy"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, cl.refusal(perm), http.StatusForbidden)
+	}
+}
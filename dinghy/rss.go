@@ -0,0 +1,104 @@
+package dinghy
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// RSS 2.0 (https://www.rssboard.org/rss-specification). Atom links carry the
+// feed's own address and hubs, and dc:creator the author, as RSS's own author
+// element needs an email address.
+type rssDoc struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	DC      string     `xml:"xmlns:dc,attr"`
+	FH      string     `xml:"xmlns:fh,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Generator     string    `xml:"generator"`
+	Archive       *struct{} `xml:"fh:archive"`
+	AtomLinks     []rssLink `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Creator     string   `xml:"dc:creator"`
+	Categories  []string `xml:"category"`
+	Description string   `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	ID          string `xml:",chardata"`
+}
+
+func rssTime(t time.Time) string {
+	return t.UTC().Format(time.RFC1123Z)
+}
+
+// renderRSS renders a feed as RSS 2.0. Items are described by their full
+// HTML, as readers expect, rather than the post's summary.
+func renderRSS(fd *feedData, feed string) ([]byte, error) {
+	description := fd.Description
+	if description == "" {
+		description = fd.Title
+	}
+
+	ch := rssChannel{
+		Title:         fd.Title,
+		Link:          fd.Home,
+		Description:   description,
+		LastBuildDate: rssTime(fd.Updated),
+		Generator:     "Dinghy",
+		Items:         make([]rssItem, len(fd.Items)),
+	}
+	for _, l := range fd.links(feed) {
+		ch.AtomLinks = append(ch.AtomLinks, rssLink{Rel: l.Rel, Href: l.Href})
+	}
+	ch.AtomLinks[0].Type = "application/rss+xml"
+	for _, hub := range fd.Hubs {
+		ch.AtomLinks = append(ch.AtomLinks, rssLink{Rel: "hub", Href: hub})
+	}
+
+	if fd.Doc.isArchive() {
+		ch.Archive = &struct{}{}
+	}
+
+	for i, it := range fd.Items {
+		ch.Items[i] = rssItem{
+			Title:       it.Title,
+			Link:        it.URL,
+			GUID:        rssGUID{false, it.ID},
+			PubDate:     rssTime(it.Published),
+			Creator:     it.Author,
+			Categories:  it.Tags,
+			Description: it.HTML,
+		}
+	}
+
+	doc := rssDoc{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		DC:      "http://purl.org/dc/elements/1.1/",
+		FH:      "http://purl.org/syndication/history/1.0",
+		Channel: ch,
+	}
+	return xml.MarshalIndent(doc, "", "    ")
+}
@@ -0,0 +1,310 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A PostIndex holds the stemmed search terms of a single post, and shares its
+// numeric ID with that post. Terms is indexed, so that a query on a term
+// returns every post containing it; Counts holds the matching term
+// frequencies. Date and Hidden are copied from the post for ranking and
+// filtering without a second lookup.
+type PostIndex struct {
+	Terms  []string
+	Counts []int     `datastore:",noindex"`
+	Length int       `datastore:",noindex"`
+	Date   time.Time `datastore:",noindex"`
+	Hidden bool
+}
+
+// Maximum number of posts fetched for each search term
+const searchTermLimit = 200
+
+// Words too common to be worth indexing
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "but": true, "by": true, "for": true, "if": true, "in": true,
+	"into": true, "is": true, "it": true, "no": true, "not": true, "of": true,
+	"on": true, "or": true, "so": true, "such": true, "that": true, "the": true,
+	"their": true, "then": true, "there": true, "these": true, "they": true,
+	"this": true, "to": true, "was": true, "will": true, "with": true,
+}
+
+// Markdown link targets and HTML tags, which shouldn't be searchable
+var markupRe = regexp.MustCompile(`\]\([^)]*\)|<[^>]*>`)
+
+// words splits s into lower-cased runs of letters and digits
+func words(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// tokenize returns the stemmed search terms of s, skipping stop words
+func tokenize(s string) []string {
+	t := make([]string, 0)
+	for _, w := range words(s) {
+		if stopWords[w] {
+			continue
+		}
+		t = append(t, stem(w))
+	}
+	return t
+}
+
+func postText(p *Post) string {
+	return markupRe.ReplaceAllLiteralString(p.Lead+p.Content, " ")
+}
+
+// indexPost replaces the search index entry for a post. Titles count double.
+func indexPost(c appengine.Context, id int64, p *Post) error {
+	counts := make(map[string]int)
+	length := 0
+	for _, t := range tokenize(p.Title) {
+		counts[t] += 2
+		length++
+	}
+	for _, t := range tokenize(postText(p)) {
+		counts[t]++
+		length++
+	}
+
+	idx := PostIndex{
+		Terms:  make([]string, 0, len(counts)),
+		Counts: make([]int, 0, len(counts)),
+		Length: length,
+		Date:   p.Date,
+		Hidden: p.Hidden,
+	}
+	for t, n := range counts {
+		idx.Terms = append(idx.Terms, t)
+		idx.Counts = append(idx.Counts, n)
+	}
+
+	k := datastore.NewKey(c, "PostIndex", "", id, nil)
+	_, err := datastore.Put(c, k, &idx)
+	return err
+}
+
+func unindexPost(c appengine.Context, id int64) error {
+	err := datastore.Delete(c, datastore.NewKey(c, "PostIndex", "", id, nil))
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+type searchHit struct {
+	id      int64
+	matched int
+	score   float64
+}
+
+// searchPosts returns the posts matching the query, best first. Posts that
+// contain more of the query terms always rank higher; among those, the score
+// is the sum of the log term frequencies, normalized by post length, and
+// decayed by the post's age in years.
+func searchPosts(query string, admin bool, c appengine.Context) ([]Post, error) {
+	terms := tokenize(query)
+	hits := make(map[int64]*searchHit)
+	now := time.Now()
+
+	seen := make(map[string]bool)
+	for _, t := range terms {
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+
+		q := datastore.NewQuery("PostIndex").Filter("Terms =", t).Limit(searchTermLimit)
+		if !admin {
+			q = q.Filter("Hidden =", false)
+		}
+
+		var idx []PostIndex
+		keys, err := q.GetAll(c, &idx)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, k := range keys {
+			tf := 0
+			for j, term := range idx[i].Terms {
+				if term == t && j < len(idx[i].Counts) {
+					tf = idx[i].Counts[j]
+				}
+			}
+
+			age := now.Sub(idx[i].Date).Hours() / (24 * 365)
+			if age < 0 {
+				age = 0
+			}
+			length := math.Max(float64(idx[i].Length), 1)
+			score := (1 + math.Log(float64(tf)+1)) / math.Sqrt(length) / (1 + age)
+
+			h := hits[k.IntID()]
+			if h == nil {
+				h = &searchHit{id: k.IntID()}
+				hits[k.IntID()] = h
+			}
+			h.matched++
+			h.score += score
+		}
+	}
+
+	ranked := make([]*searchHit, 0, len(hits))
+	for _, h := range hits {
+		ranked = append(ranked, h)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].matched != ranked[j].matched {
+			return ranked[i].matched > ranked[j].matched
+		}
+		return ranked[i].score > ranked[j].score
+	})
+	if len(ranked) > 20 {
+		ranked = ranked[:20]
+	}
+
+	keys := make([]*datastore.Key, len(ranked))
+	for i, h := range ranked {
+		keys[i] = datastore.NewKey(c, "Post", "", h.id, nil)
+	}
+	p := make([]Post, len(keys))
+	err := datastore.GetMulti(c, keys, p)
+
+	// The term query is eventually consistent, so may still find posts that
+	// were just deleted
+	missing, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+
+	found := make([]Post, 0, len(p))
+	for i := range p {
+		if ok && missing[i] == datastore.ErrNoSuchEntity {
+			continue
+		} else if ok && missing[i] != nil {
+			return nil, missing[i]
+		}
+		p[i].ID = ranked[i].id
+		p[i].Snippet = snippet(postText(&p[i]), terms)
+		p[i].Content = ""
+		found = append(found, p[i])
+	}
+	return found, nil
+}
+
+// snippet returns an HTML excerpt of s around the first query term found,
+// with each matching word wrapped in <mark> tags.
+func snippet(s string, terms []string) string {
+	const width = 30
+
+	match := make(map[string]bool)
+	for _, t := range terms {
+		match[t] = true
+	}
+
+	fields := strings.Fields(s)
+	start := 0
+	for i, f := range fields {
+		if w := words(f); len(w) > 0 && match[stem(w[0])] {
+			start = i - width/3
+			break
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := start + width
+	if end > len(fields) {
+		end = len(fields)
+	}
+
+	var out []string
+	if start > 0 {
+		out = append(out, "&hellip;")
+	}
+	for _, f := range fields[start:end] {
+		if w := words(f); len(w) > 0 && match[stem(w[0])] {
+			out = append(out, "<mark>"+html.EscapeString(f)+"</mark>")
+		} else {
+			out = append(out, html.EscapeString(f))
+		}
+	}
+	if end < len(fields) {
+		out = append(out, "&hellip;")
+	}
+	return strings.Join(out, " ")
+}
+
+// search displays the results of the "q" query with the blog template. Results
+// are not cached, as the space of possible queries is unbounded.
+func search(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	b, err := getBlogInfo(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b.Admin = isAdmin(c, r)
+	b.Search = true
+	b.Query = strings.TrimSpace(r.FormValue("q"))
+
+	if b.Query != "" {
+		b.Posts, err = searchPosts(b.Query, b.Admin, c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := writePost(w, b, c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// indexAll indexes every post, returning how many there are
+func indexAll(c appengine.Context) (int, error) {
+	var p []Post
+	keys, err := datastore.NewQuery("Post").GetAll(c, &p)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, k := range keys {
+		if err := indexPost(c, k.IntID(), &p[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// AJAX functions
+
+// reindex rebuilds the search index for every post, for blogs with posts
+// saved before search was available.
+func reindex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n, err := indexAll(appengine.NewContext(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "success: %d posts indexed", n)
+}
@@ -0,0 +1,279 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+ *  Sitemaps (https://www.sitemaps.org/protocol.html) listing the home page,
+ *  every visible post, and the archive, tag and author pages, each dated by its
+ *  newest post. A sitemap holds at most 50,000 addresses, so larger blogs get
+ *  a sitemap index at /sitemap.xml, pointing at "/sitemap.xml?page=1" and so
+ *  on. Sitemaps are cached like pages, until the next post is saved.
+ *
+ *  robots.txt is generated too, so it can point at the sitemap on the blog's
+ *  configured address.
+ */
+
+const sitemapSize = 50000
+
+var errNoSitemap = errors.New("No such sitemap page")
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+// A sitemapEntry is an address before rendering, with the date of its newest
+// post
+type sitemapEntry struct {
+	Path     string
+	Modified time.Time
+}
+
+// sitemapEntries lists the blog's public addresses: the home page, the posts,
+// newest first, then the archives, tags and authors
+func sitemapEntries(c appengine.Context) ([]sitemapEntry, error) {
+	var home sitemapEntry
+	posts := make([]sitemapEntry, 0)
+	periods := make(map[string]time.Time)
+	tags := make(map[string]time.Time)
+
+	// Only authors that still exist have pages
+	keys, err := datastore.NewQuery("Author").KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	for _, k := range keys {
+		known[k.StringID()] = true
+	}
+	authors := make(map[string]time.Time)
+
+	// Pages are dated by their newest post. Only the properties that date and
+	// group posts are read, by a projection each, as a projection skips the
+	// entities missing any of its properties, such as posts saved before
+	// they had an author, or an indexed Updated date.
+	newer := func(m map[string]time.Time, k string, t time.Time) {
+		if t.After(m[k]) {
+			m[k] = t
+		}
+	}
+	each := func(q *datastore.Query, f func(id int64, p *Post)) error {
+		for it := q.Filter("Hidden =", false).Run(c); ; {
+			var p Post
+			k, err := it.Next(&p)
+			if err == datastore.Done {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			f(k.IntID(), &p)
+		}
+	}
+
+	// Posts are dated by when they were published, or last edited
+	ids := make([]int64, 0)
+	dates := make(map[int64]time.Time)
+	modified := make(map[int64]time.Time)
+	err = each(datastore.NewQuery("Post").Order("-Date").Project("Date"), func(id int64, p *Post) {
+		ids = append(ids, id)
+		dates[id], modified[id] = p.Date, p.Date
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = each(datastore.NewQuery("Post").Project("Updated"), func(id int64, p *Post) {
+		if t, ok := modified[id]; ok && p.Updated.After(t) {
+			modified[id] = p.Updated
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		t := modified[id]
+		if t.After(home.Modified) {
+			home.Modified = t
+		}
+		posts = append(posts, sitemapEntry{"/" + strconv.FormatInt(id, 10), t})
+
+		d := dates[id].UTC()
+		newer(periods, fmt.Sprintf("/%04d", d.Year()), t)
+		newer(periods, fmt.Sprintf("/%04d/%02d", d.Year(), d.Month()), t)
+	}
+
+	// A post has a result for each of its tags
+	err = each(datastore.NewQuery("Post").Project("Tags"), func(id int64, p *Post) {
+		for _, t := range p.Tags {
+			newer(tags, tagPath(t), modified[id])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = each(datastore.NewQuery("Post").Project("AuthorID"), func(id int64, p *Post) {
+		if known[p.AuthorID] {
+			newer(authors, authorPath(p.AuthorID), modified[id])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	home.Path = "/"
+	e := []sitemapEntry{home, {"/archive", home.Modified}}
+	e = append(e, posts...)
+	e = append(e, sortedEntries(periods)...)
+	e = append(e, sortedEntries(tags)...)
+	return append(e, sortedEntries(authors)...), nil
+}
+
+// sortedEntries returns a map's entries ordered by path
+func sortedEntries(m map[string]time.Time) []sitemapEntry {
+	e := make([]sitemapEntry, 0, len(m))
+	for path, t := range m {
+		e = append(e, sitemapEntry{path, t})
+	}
+	sort.Slice(e, func(i, j int) bool { return e[i].Path < e[j].Path })
+	return e
+}
+
+func sitemapDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// renderSitemap renders the entries in a document of a blog's sitemap. Page 0
+// is /sitemap.xml itself, which is an index if there's more than one page.
+func renderSitemap(base string, entries []sitemapEntry, page int) ([]byte, error) {
+	pages := (len(entries) + sitemapSize - 1) / sitemapSize
+	if page > pages || (page > 0 && pages == 1) {
+		return nil, errNoSitemap
+	}
+
+	var doc interface{}
+	if page == 0 && pages > 1 {
+		index := sitemapIndex{}
+		for n := 1; n <= pages; n++ {
+			var latest time.Time
+			for _, e := range entries[(n-1)*sitemapSize : minInt(n*sitemapSize, len(entries))] {
+				if e.Modified.After(latest) {
+					latest = e.Modified
+				}
+			}
+			loc := base + "/sitemap.xml?page=" + strconv.Itoa(n)
+			index.Sitemaps = append(index.Sitemaps, sitemapURL{loc, sitemapDate(latest)})
+		}
+		doc = index
+	} else {
+		if page == 0 {
+			page = 1
+		}
+		set := sitemapURLSet{URLs: make([]sitemapURL, 0)}
+		for _, e := range entries[(page-1)*sitemapSize : minInt(page*sitemapSize, len(entries))] {
+			set.URLs = append(set.URLs, sitemapURL{base + e.Path, sitemapDate(e.Modified)})
+		}
+		doc = set
+	}
+
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// sitemap serves /sitemap.xml, and the pages of a sitemap index
+func sitemap(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	page := 0
+	if s := r.FormValue("page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+		page = n
+	}
+
+	key := "sitemap." + strconv.Itoa(page)
+	if p, err := getCachedPage(c, key); err == nil {
+		p.write(w, r)
+		return
+	}
+
+	b, err := getBlogInfo(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries, err := sitemapEntries(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out, err := renderSitemap(siteURL(b, c), entries, page)
+	if err == errNoSitemap {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Deleting a post changes the sitemap without dating anything, so as
+	// with pages, it's dated by when it was rendered
+	p := newCachedPage(out, "application/xml; charset=utf-8", time.Now(), cacheControl(b, "/sitemap.xml"))
+	p.cache(c, key)
+	p.write(w, r)
+}
+
+// robots serves robots.txt, keeping crawlers out of the admin pages and
+// pointing them at the sitemap
+func robots(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	b, err := getBlogInfo(c)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	body := "User-agent: *\n" +
+		"Disallow: /admin\n" +
+		"Disallow: /list\n" +
+		"Disallow: /login\n" +
+		"\n" +
+		"Sitemap: " + siteURL(b, c) + "/sitemap.xml\n"
+	p := newCachedPage([]byte(body), "text/plain; charset=utf-8", time.Time{}, cacheControl(b, "/robots.txt"))
+	p.write(w, r)
+}
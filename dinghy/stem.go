@@ -0,0 +1,203 @@
+package dinghy
+
+/**
+ *  An implementation of the Porter stemming algorithm, as described in
+ *  M.F. Porter, "An algorithm for suffix stripping", Program 14(3), 1980, and
+ *  at http://tartarus.org/martin/PorterStemmer/. Words are expected to be
+ *  lower case ASCII; anything else is returned unchanged.
+ */
+
+import (
+	"strings"
+)
+
+// isConsonant reports whether w[i] is a consonant. A "y" is a consonant
+// unless it follows another consonant.
+func isConsonant(w string, i int) bool {
+	switch w[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		if i == 0 {
+			return true
+		}
+		return !isConsonant(w, i-1)
+	}
+	return true
+}
+
+// measure returns m, the number of VC sequences in [C](VC)^m[V]
+func measure(w string) int {
+	m := 0
+	i := 0
+	n := len(w)
+
+	// Skip the leading consonants
+	for i < n && isConsonant(w, i) {
+		i++
+	}
+	for i < n {
+		for i < n && !isConsonant(w, i) {
+			i++
+		}
+		if i == n {
+			break
+		}
+		for i < n && isConsonant(w, i) {
+			i++
+		}
+		m++
+	}
+	return m
+}
+
+func hasVowel(w string) bool {
+	for i := 0; i < len(w); i++ {
+		if !isConsonant(w, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// endsDouble reports whether w ends with a double consonant
+func endsDouble(w string) bool {
+	n := len(w)
+	return n > 1 && w[n-1] == w[n-2] && isConsonant(w, n-1)
+}
+
+// endsCVC reports whether w ends consonant-vowel-consonant, where the final
+// consonant is not w, x or y. For example, "hop", but not "snow".
+func endsCVC(w string) bool {
+	n := len(w)
+	if n < 3 || !isConsonant(w, n-1) || isConsonant(w, n-2) || !isConsonant(w, n-3) {
+		return false
+	}
+	switch w[n-1] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
+
+// replaceSuffix swaps the first matching suffix in rules, if the remaining
+// stem has a measure greater than min. The boolean result reports whether a
+// suffix matched at all, whether or not it was replaced.
+func replaceSuffix(w string, rules [][2]string, min int) (string, bool) {
+	for _, r := range rules {
+		if strings.HasSuffix(w, r[0]) {
+			stem := w[:len(w)-len(r[0])]
+			if measure(stem) > min {
+				return stem + r[1], true
+			}
+			return w, true
+		}
+	}
+	return w, false
+}
+
+var step2Rules = [][2]string{
+	{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"},
+	{"izer", "ize"}, {"bli", "ble"}, {"alli", "al"}, {"entli", "ent"},
+	{"eli", "e"}, {"ousli", "ous"}, {"ization", "ize"}, {"ation", "ate"},
+	{"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"},
+	{"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+	{"logi", "log"},
+}
+
+var step3Rules = [][2]string{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"},
+	{"ical", "ic"}, {"ful", ""}, {"ness", ""},
+}
+
+// Longest suffixes first, so "ement" is tried before "ment" and "ent"
+var step4Suffixes = []string{
+	"ement", "ance", "ence", "able", "ible", "ment", "ant", "ent", "ism",
+	"ate", "iti", "ous", "ive", "ize", "ion", "al", "er", "ic", "ou",
+}
+
+func stem(w string) string {
+	if len(w) <= 2 {
+		return w
+	}
+	for i := 0; i < len(w); i++ {
+		if w[i] < 'a' || w[i] > 'z' {
+			return w
+		}
+	}
+
+	// Step 1a: plurals
+	switch {
+	case strings.HasSuffix(w, "sses"):
+		w = w[:len(w)-2]
+	case strings.HasSuffix(w, "ies"):
+		w = w[:len(w)-2]
+	case strings.HasSuffix(w, "ss"):
+	case strings.HasSuffix(w, "s"):
+		w = w[:len(w)-1]
+	}
+
+	// Step 1b: past tense and gerunds
+	extra := false
+	switch {
+	case strings.HasSuffix(w, "eed"):
+		if measure(w[:len(w)-3]) > 0 {
+			w = w[:len(w)-1]
+		}
+	case strings.HasSuffix(w, "ed") && hasVowel(w[:len(w)-2]):
+		w = w[:len(w)-2]
+		extra = true
+	case strings.HasSuffix(w, "ing") && hasVowel(w[:len(w)-3]):
+		w = w[:len(w)-3]
+		extra = true
+	}
+	if extra {
+		switch {
+		case strings.HasSuffix(w, "at"), strings.HasSuffix(w, "bl"), strings.HasSuffix(w, "iz"):
+			w += "e"
+		case endsDouble(w) && !strings.HasSuffix(w, "l") && !strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "z"):
+			w = w[:len(w)-1]
+		case measure(w) == 1 && endsCVC(w):
+			w += "e"
+		}
+	}
+
+	// Step 1c: terminal y to i, when there's another vowel
+	if strings.HasSuffix(w, "y") && hasVowel(w[:len(w)-1]) {
+		w = w[:len(w)-1] + "i"
+	}
+
+	// Steps 2 and 3: double and single suffixes
+	w, _ = replaceSuffix(w, step2Rules, 0)
+	w, _ = replaceSuffix(w, step3Rules, 0)
+
+	// Step 4: remove suffixes from longer stems
+	for _, s := range step4Suffixes {
+		if !strings.HasSuffix(w, s) {
+			continue
+		}
+		base := w[:len(w)-len(s)]
+		if measure(base) > 1 {
+			if s != "ion" || strings.HasSuffix(base, "s") || strings.HasSuffix(base, "t") {
+				w = base
+			}
+		}
+		break
+	}
+
+	// Step 5a: remove a final e
+	if strings.HasSuffix(w, "e") {
+		base := w[:len(w)-1]
+		m := measure(base)
+		if m > 1 || (m == 1 && !endsCVC(base)) {
+			w = base
+		}
+	}
+
+	// Step 5b: -ll to -l on longer stems
+	if measure(w) > 1 && endsDouble(w) && strings.HasSuffix(w, "l") {
+		w = w[:len(w)-1]
+	}
+
+	return w
+}
@@ -0,0 +1,186 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A Token lets scripts and editors call the admin endpoints without an App
+// Engine login. Only a SHA-256 hash of the secret is stored, as the key name,
+// so the secret itself is shown once, when the token is created.
+type Token struct {
+	Name     string
+	Scopes   []string `datastore:",noindex"`
+	Created  time.Time
+	LastUsed time.Time `datastore:",noindex"`
+	Revoked  bool      `datastore:",noindex"`
+	ID       string    `datastore:"-"`
+}
+
+// Token scopes. Each scope includes the ones before it, and acts in a role
+// (see roles.go).
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+)
+
+var scopeRank = map[string]int{scopeRead: 1, scopeWrite: 2, scopeAdmin: 3}
+
+// LastUsed is only rewritten when it's at least this stale, to avoid a
+// datastore write on every request
+const lastUsedResolution = time.Minute
+
+var errNoToken = errors.New("No token")
+
+func hashSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// requestToken returns the token sent with a request, either as a bearer
+// token, or as the password of HTTP basic authentication.
+func requestToken(c appengine.Context, r *http.Request) (*Token, error) {
+	secret := ""
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		secret = strings.TrimSpace(auth[len("Bearer "):])
+	} else if _, pw, ok := r.BasicAuth(); ok {
+		secret = pw
+	}
+	if secret == "" {
+		return nil, errNoToken
+	}
+	return lookupToken(c, secret)
+}
+
+// lookupToken finds an unrevoked token by its secret, and records its use
+func lookupToken(c appengine.Context, secret string) (*Token, error) {
+	t := &Token{}
+	k := datastore.NewKey(c, "Token", hashSecret(secret), 0, nil)
+	if err := datastore.Get(c, k, t); err != nil {
+		return nil, err
+	}
+	if t.Revoked {
+		return nil, errors.New("Token has been revoked")
+	}
+	t.ID = k.StringID()
+
+	if time.Since(t.LastUsed) > lastUsedResolution {
+		t.LastUsed = time.Now()
+		if _, err := datastore.Put(c, k, t); err != nil {
+			c.Warningf("Recording token use: %v", err)
+		}
+	}
+	return t, nil
+}
+
+// newSecret returns a random token secret
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "dinghy_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AJAX functions
+
+// tokens lists tokens on GET. On POST, the "action" form value "create"
+// issues a token with the given Name and Scopes, returning its secret, and
+// "revoke" revokes the token with the given ID.
+func tokens(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	switch r.FormValue("action") {
+	case "":
+		t := make([]Token, 0)
+		keys, err := datastore.NewQuery("Token").Order("-Created").GetAll(c, &t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i := range t {
+			t[i].ID = keys[i].StringID()
+		}
+
+		j, err := json.Marshal(t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%s", j)
+
+	case "create":
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		t := Token{
+			Name:    strings.TrimSpace(r.FormValue("Name")),
+			Created: time.Now(),
+		}
+		if t.Name == "" {
+			http.Error(w, "A token name is required", http.StatusBadRequest)
+			return
+		}
+		r.ParseForm()
+		for _, s := range r.Form["Scopes"] {
+			if scopeRank[s] == 0 {
+				http.Error(w, "Unknown scope: "+s, http.StatusBadRequest)
+				return
+			}
+			t.Scopes = append(t.Scopes, s)
+		}
+		if len(t.Scopes) == 0 {
+			http.Error(w, "At least one scope is required", http.StatusBadRequest)
+			return
+		}
+
+		secret, err := newSecret()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		k := datastore.NewKey(c, "Token", hashSecret(secret), 0, nil)
+		if _, err := datastore.Put(c, k, &t); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprint(w, secret)
+
+	case "revoke":
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		t := Token{}
+		k := datastore.NewKey(c, "Token", r.FormValue("ID"), 0, nil)
+		if err := datastore.Get(c, k, &t); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		t.Revoked = true
+		if _, err := datastore.Put(c, k, &t); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "success")
+
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+	}
+}
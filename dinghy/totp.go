@@ -0,0 +1,80 @@
+package dinghy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+ *  Time-based one-time passwords (RFC 6238), the six digit codes shown by
+ *  authenticator apps, for two-factor login to local accounts. A code changes
+ *  every 30 seconds, and the codes either side of the current one are
+ *  accepted too, to allow for clocks that differ a little.
+ */
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// Steps either side of now that are accepted
+	totpSkew = 1
+)
+
+// newTOTPSecret returns a random secret, base32 encoded as authenticator apps
+// expect
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(b), nil
+}
+
+// hotp returns the code for a counter (RFC 4226)
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	off := sum[len(sum)-1] & 0xf
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, v%mod)
+}
+
+// checkTOTP returns the time step of a code, if it's valid at the given time
+// and for a later step than last, so that no code is accepted twice
+func checkTOTP(secret, code string, now time.Time, last int64) (int64, bool) {
+	key, err := base32.StdEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || secret == "" {
+		return 0, false
+	}
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+
+	step := now.Unix() / totpPeriod
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		if s > last && hmac.Equal([]byte(hotp(key, uint64(s))), []byte(code)) {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth URI that sets up an authenticator app, usually
+// shown as a QR code
+func totpURI(issuer, login, secret string) string {
+	// Some apps show a "+" for a space literally
+	esc := func(s string) string { return strings.Replace(url.QueryEscape(s), "+", "%20", -1) }
+	return "otpauth://totp/" + esc(issuer) + ":" + esc(login) + "?secret=" + secret + "&issuer=" + esc(issuer)
+}
@@ -0,0 +1,322 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/urlfetch"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ *  Webmention (https://www.w3.org/TR/webmention/) support. Incoming mentions
+ *  are POSTed to "/webmention", and verified later by a task that fetches the
+ *  source and checks it links to the post. Verified mentions are stored as
+ *  Mention children of the Post, keyed by source URL, so a repeated
+ *  notification updates or, if the link is gone, removes the mention.
+ *
+ *  When a visible post is saved, a task renders it, and notifies the
+ *  Webmention endpoint of each page it links to.
+ */
+
+type Mention struct {
+	Source string
+	Title  string `datastore:",noindex"`
+	Date   time.Time
+}
+
+// An httpClient makes the outgoing requests. On App Engine, that's urlfetch;
+// newHTTPClient can be replaced to point the code at a local stub server.
+type httpClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+var newHTTPClient = func(c appengine.Context) httpClient {
+	return urlfetch.Client(c)
+}
+
+// Pages larger than this are only searched up to this point
+const mentionFetchLimit = 1 << 20
+
+var (
+	linkTagRe    = regexp.MustCompile(`(?is)<(?:a|link)\b[^>]*>`)
+	hrefAttrRe   = attrRe("href")
+	relAttrRe    = attrRe("rel")
+	linkHeaderRe = regexp.MustCompile(`<([^>]*)>\s*;[^,]*?\brel="?([^",;]*)"?`)
+	titleRe      = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	errNoLink    = errors.New("Source does not link to target")
+)
+
+// attrRe matches an attribute in an HTML tag, quoted or not
+func attrRe(name string) *regexp.Regexp {
+	return regexp.MustCompile(`(?is)\s` + name + `\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+}
+
+// attr returns the value of the attribute matched by re
+func attr(tag string, re *regexp.Regexp) (string, bool) {
+	m := re.FindStringSubmatch(tag)
+	if m == nil {
+		return "", false
+	}
+	return html.UnescapeString(strings.Trim(m[1], `"'`)), true
+}
+
+// hasRel reports whether a space separated rel value includes rel
+func hasRel(rels, rel string) bool {
+	for _, r := range strings.Fields(rels) {
+		if strings.EqualFold(r, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// links returns the targets of the links in an HTML document
+func links(doc string) []string {
+	l := make([]string, 0)
+	for _, tag := range linkTagRe.FindAllString(doc, -1) {
+		if href, ok := attr(tag, hrefAttrRe); ok {
+			l = append(l, href)
+		}
+	}
+	return l
+}
+
+// fetch GETs a page, returning the response and up to mentionFetchLimit bytes
+// of its body
+func fetch(c appengine.Context, u string) (*http.Response, string, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := newHTTPClient(c).Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, mentionFetchLimit))
+	return resp, string(body), err
+}
+
+// mentionTarget returns the ID of the post a target URL refers to, if it's
+// one of ours
+func mentionTarget(c appengine.Context, r *http.Request, target string) (int64, bool) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return 0, false
+	}
+	if u.Host != r.Host && u.Host != appengine.DefaultVersionHostname(c) {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(strings.Trim(u.Path, "/"), 10, 64)
+	return id, err == nil
+}
+
+// webmention handles "/webmention", queueing the mention for verification
+func webmention(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	source, target := r.FormValue("source"), r.FormValue("target")
+	if u, err := url.Parse(source); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		http.Error(w, "source must be an http or https URL", http.StatusBadRequest)
+		return
+	}
+	if source == target {
+		http.Error(w, "source and target must differ", http.StatusBadRequest)
+		return
+	}
+
+	id, ok := mentionTarget(c, r, target)
+	if !ok {
+		http.Error(w, "target is not a post on this site", http.StatusBadRequest)
+		return
+	}
+	p := Post{}
+	if err := datastore.Get(c, datastore.NewKey(c, "Post", "", id, nil), &p); err != nil || p.Hidden {
+		http.Error(w, "target is not a post on this site", http.StatusBadRequest)
+		return
+	}
+
+	verifyMention.Call(c, source, target, id)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprint(w, "Webmention queued for verification")
+}
+
+var verifyMention = delay.Func("verifyMention", func(c appengine.Context, source, target string, id int64) error {
+	pk := datastore.NewKey(c, "Post", "", id, nil)
+	k := datastore.NewKey(c, "Mention", source, 0, pk)
+
+	m, err := checkMention(c, source, target)
+	if err != nil && err != errNoLink {
+		// Returning an error retries the task
+		return err
+	}
+
+	defer expirePost(c, id)
+	if err == errNoLink {
+		c.Infof("Removing mention of %s from %s: %v", target, source, err)
+		if err := datastore.Delete(c, k); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		return nil
+	}
+	_, err = datastore.Put(c, k, &m)
+	return err
+})
+
+// checkMention fetches a mention's source, and returns the Mention if it
+// links to the target, or errNoLink if it doesn't, or is gone
+func checkMention(c appengine.Context, source, target string) (Mention, error) {
+	m := Mention{Source: source, Date: time.Now()}
+	resp, body, err := fetch(c, source)
+	if err != nil {
+		return m, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		return m, errNoLink
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return m, fmt.Errorf("Fetching %s: %s", source, resp.Status)
+	}
+
+	err = errNoLink
+	for _, l := range links(body) {
+		if l == target {
+			err = nil
+			break
+		}
+	}
+	if t := titleRe.FindStringSubmatch(body); t != nil {
+		m.Title = strings.TrimSpace(html.UnescapeString(t[1]))
+	}
+	return m, err
+}
+
+// getMentions returns the verified mentions of a post, oldest first
+func getMentions(id int64, c appengine.Context) ([]Mention, error) {
+	m := make([]Mention, 0)
+	pk := datastore.NewKey(c, "Post", "", id, nil)
+	_, err := datastore.NewQuery("Mention").Ancestor(pk).Order("Date").GetAll(c, &m)
+	return m, err
+}
+
+// sendMentions notifies the pages a post links to. It's queued by postSaved.
+var sendMentions = delay.Func("sendMentions", func(c appengine.Context, id int64) error {
+	p, err := getPost(strconv.FormatInt(id, 10), false, c)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	b, err := getBlogInfo(c)
+	if err != nil {
+		return err
+	}
+
+	host := appengine.DefaultVersionHostname(c)
+	source := siteURL(b, c) + "/" + strconv.FormatInt(id, 10)
+	seen := map[string]bool{}
+	for _, target := range links(markdown(p.Lead, p.Content, blogEmbeds(b.Embeds))) {
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == host || seen[target] {
+			continue
+		}
+		seen[target] = true
+
+		// One failing site shouldn't stop the others, or retry them all
+		if err := sendMention(c, source, target); err != nil {
+			c.Infof("Webmention to %s: %v", target, err)
+		}
+	}
+	return nil
+})
+
+// sendMention discovers the target's Webmention endpoint, if it has one, and
+// notifies it
+func sendMention(c appengine.Context, source, target string) error {
+	endpoint, err := discoverEndpoint(c, target)
+	if err != nil || endpoint == "" {
+		return err
+	}
+
+	form := url.Values{"source": {source}, "target": {target}}
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := newHTTPClient(c).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	return nil
+}
+
+// discoverEndpoint finds a page's Webmention endpoint, from its HTTP Link
+// header, or the first <link> or <a> element with rel="webmention". An empty
+// string means it has none.
+func discoverEndpoint(c appengine.Context, target string) (string, error) {
+	resp, body, err := fetch(c, target)
+	if err != nil {
+		return "", err
+	}
+
+	// Relative endpoints are resolved against the final URL, after redirects
+	base, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	if resp.Request != nil {
+		base = resp.Request.URL
+	}
+	resolve := func(ref string) (string, error) {
+		u, err := base.Parse(ref)
+		if err != nil {
+			return "", err
+		}
+		return u.String(), nil
+	}
+
+	for _, h := range resp.Header["Link"] {
+		for _, m := range linkHeaderRe.FindAllStringSubmatch(h, -1) {
+			if hasRel(m[2], "webmention") {
+				return resolve(m[1])
+			}
+		}
+	}
+
+	if !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return "", nil
+	}
+	for _, tag := range linkTagRe.FindAllString(body, -1) {
+		rel, _ := attr(tag, relAttrRe)
+		if href, ok := attr(tag, hrefAttrRe); ok && hasRel(rel, "webmention") {
+			return resolve(href)
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,171 @@
+package dinghy
+
+import (
+	"appengine"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// stubClient points outgoing requests at local test servers, rather than
+// urlfetch, until the returned function is called
+func stubClient() func() {
+	old := newHTTPClient
+	newHTTPClient = func(c appengine.Context) httpClient {
+		return http.DefaultClient
+	}
+	return func() { newHTTPClient = old }
+}
+
+// A mentionReceiver is a site with a Webmention endpoint at /endpoint, which
+// records the mentions it receives
+type mentionReceiver struct {
+	*httptest.Server
+	received []url.Values
+	status   int
+}
+
+func newMentionReceiver(page http.HandlerFunc) *mentionReceiver {
+	m := &mentionReceiver{status: http.StatusAccepted}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/post", page)
+	mux.HandleFunc("/endpoint", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		r.ParseForm()
+		m.received = append(m.received, r.PostForm)
+		w.WriteHeader(m.status)
+	})
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+func TestSendMention(t *testing.T) {
+	defer stubClient()()
+	const source = "https://blog.example/1"
+
+	tests := []struct {
+		name string
+		page http.HandlerFunc
+		sent bool
+	}{
+		{"link header", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Link", `<https://other.example/>; rel="me", </endpoint>; rel="webmention"`)
+			fmt.Fprint(w, "A post")
+		}, true},
+		{"link element", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, `<html><head><link rel="stylesheet" href="/style.css"><link href="endpoint" rel="webmention"></head></html>`)
+		}, true},
+		{"anchor element", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<p>Send a <a rel='nofollow webmention' href='/endpoint'>mention</a></p>`)
+		}, true},
+		{"header before html", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Link", `</endpoint>; rel=webmention`)
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<link rel="webmention" href="/elsewhere">`)
+		}, true},
+		{"no endpoint", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<a href="/endpoint">Not an endpoint</a>`)
+		}, false},
+		{"not html", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, `<link rel="webmention" href="/endpoint">`)
+		}, false},
+	}
+
+	for _, tt := range tests {
+		site := newMentionReceiver(tt.page)
+		target := site.URL + "/post"
+		if err := sendMention(nil, source, target); err != nil {
+			t.Errorf("%s: sendMention: %v", tt.name, err)
+		}
+		site.Close()
+
+		if !tt.sent {
+			if len(site.received) != 0 {
+				t.Errorf("%s: sent %v, want nothing", tt.name, site.received)
+			}
+			continue
+		}
+		if len(site.received) != 1 {
+			t.Errorf("%s: sent %d mentions, want 1", tt.name, len(site.received))
+			continue
+		}
+		if got := site.received[0]; got.Get("source") != source || got.Get("target") != target {
+			t.Errorf("%s: sent source %q, target %q, want %q, %q", tt.name, got.Get("source"), got.Get("target"), source, target)
+		}
+	}
+}
+
+func TestSendMentionRejected(t *testing.T) {
+	defer stubClient()()
+
+	site := newMentionReceiver(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `</endpoint>; rel="webmention"`)
+	})
+	defer site.Close()
+	site.status = http.StatusBadRequest
+
+	if err := sendMention(nil, "https://blog.example/1", site.URL+"/post"); err == nil {
+		t.Error("sendMention succeeded, though the endpoint refused the mention")
+	}
+}
+
+func TestCheckMention(t *testing.T) {
+	defer stubClient()()
+	const target = "https://blog.example/1"
+
+	tests := []struct {
+		name  string
+		page  http.HandlerFunc
+		err   error
+		title string
+	}{
+		{"links to target", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `<title> Re: A &amp; B </title><p>About <a href="`+target+`">this</a></p>`)
+		}, nil, "Re: A & B"},
+		{"links elsewhere", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `<a href="https://blog.example/2">Another post</a>`)
+		}, errNoLink, ""},
+		{"gone", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Gone", http.StatusGone)
+		}, errNoLink, ""},
+	}
+
+	for _, tt := range tests {
+		site := httptest.NewServer(tt.page)
+		source := site.URL + "/reply"
+		m, err := checkMention(nil, source, target)
+		site.Close()
+
+		if err != tt.err {
+			t.Errorf("%s: checkMention error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && (m.Source != source || m.Title != tt.title) {
+			t.Errorf("%s: got source %q, title %q, want %q, %q", tt.name, m.Source, m.Title, source, tt.title)
+		}
+	}
+}
+
+func TestCheckMentionUnavailable(t *testing.T) {
+	defer stubClient()()
+
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Try later", http.StatusServiceUnavailable)
+	}))
+	defer site.Close()
+
+	// Anything but errNoLink retries the task, rather than removing the mention
+	_, err := checkMention(nil, site.URL+"/reply", "https://blog.example/1")
+	if err == nil || err == errNoLink {
+		t.Errorf("checkMention error %v, want a temporary failure", err)
+	}
+}
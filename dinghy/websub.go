@@ -0,0 +1,85 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/delay"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+ *  WebSub (https://www.w3.org/TR/websub/) publishing. The blog's hubs are
+ *  advertised in each feed, and are pinged when a visible post is saved, so
+ *  subscribers hear about it without polling. Each hub is pinged about each
+ *  feed by its own task, which the task queue retries until the hub accepts
+ *  the notification.
+ *
+ *  cmd/fakehub is a stand-in hub for trying this out on the development
+ *  server.
+ */
+
+// parseHubs reads the hub list from the settings form, one URL per line
+func parseHubs(s string) ([]string, error) {
+	hubs := make([]string, 0)
+	for _, h := range strings.Split(s, "\n") {
+		if h = strings.TrimSpace(h); h != "" {
+			hubs = append(hubs, h)
+		}
+	}
+	return hubs, validateHubs(hubs)
+}
+
+func validateHubs(hubs []string) error {
+	for _, h := range hubs {
+		u, err := url.Parse(h)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Hub %q is not an http or https URL", h)
+		}
+	}
+	return nil
+}
+
+// notifyHubs queues a ping to each hub for each feed, telling it the feeds
+// have changed
+func notifyHubs(c appengine.Context) {
+	b, err := getBlogInfo(c)
+	if err != nil {
+		c.Warningf("Not notifying hubs: %v", err)
+		return
+	}
+
+	base := siteURL(b, c)
+	for _, hub := range b.Hubs {
+		for _, ff := range feedFormats {
+			pingHub.Call(c, hub, ff.url(base))
+		}
+	}
+}
+
+var pingHub = delay.Func("pingHub", publishToHub)
+
+// publishToHub tells a hub that a feed has changed. Returning an error
+// retries the pingHub task.
+func publishToHub(c appengine.Context, hub, topic string) error {
+	form := url.Values{"hub.mode": {"publish"}, "hub.url": {topic}}
+	req, err := http.NewRequest("POST", hub, strings.NewReader(form.Encode()))
+	if err != nil {
+		// A malformed hub URL won't improve with retries
+		c.Errorf("Pinging hub %s: %v", hub, err)
+		return nil
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := newHTTPClient(c).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Hub %s returned %s", hub, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package dinghy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublishToHubRetries(t *testing.T) {
+	defer stubClient()()
+	const topic = "https://blog.example/atom.xml"
+
+	// The hub refuses the first ping, as a busy hub might
+	pings := 0
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pings++
+		if r.Method != "POST" || r.FormValue("hub.mode") != "publish" || r.FormValue("hub.url") != topic {
+			t.Errorf("Ping %d: %s with hub.mode=%q hub.url=%q, want a publish of %q", pings, r.Method, r.FormValue("hub.mode"), r.FormValue("hub.url"), topic)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if pings == 1 {
+			http.Error(w, "Busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer hub.Close()
+
+	// An error retries the task, so the ping is sent again
+	if err := publishToHub(nil, hub.URL, topic); err == nil {
+		t.Fatal("First ping succeeded, though the hub refused it")
+	}
+	if err := publishToHub(nil, hub.URL, topic); err != nil {
+		t.Fatalf("Retried ping: %v", err)
+	}
+	if pings != 2 {
+		t.Errorf("Hub received %d pings, want 2", pings)
+	}
+}
@@ -0,0 +1,273 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ *  Importing from WordPress eXtended RSS (WXR) exports. Posts and pages
+ *  become Posts, keeping their dates, titles, slugs, tags and categories,
+ *  draft status and HTML content, which markdown passes through unchanged.
+ *  Each old permalink gets a Redirect to the new post, which also stops a
+ *  second import of the same export from duplicating posts.
+ *
+ *  The "/import" admin endpoint takes the export as the "file" upload, and
+ *  with "dryrun" set, reports what would be imported without saving
+ *  anything. cmd/wxrimport uploads an export from the command line.
+ */
+
+// The parts of a WXR export we use. WordPress versions the "wp" namespace, so
+// its elements are matched by local name only.
+type wxrExport struct {
+	Items []wxrItem `xml:"channel>item"`
+}
+
+type wxrItem struct {
+	Title      string        `xml:"title"`
+	Link       string        `xml:"link"`
+	PubDate    string        `xml:"pubDate"`
+	Encoded    []wxrEncoded  `xml:"encoded"`
+	PostID     string        `xml:"post_id"`
+	DateGMT    string        `xml:"post_date_gmt"`
+	Date       string        `xml:"post_date"`
+	Slug       string        `xml:"post_name"`
+	Status     string        `xml:"status"`
+	Type       string        `xml:"post_type"`
+	Categories []wxrCategory `xml:"category"`
+}
+
+// content:encoded and excerpt:encoded differ only by namespace
+type wxrEncoded struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+}
+
+type wxrCategory struct {
+	Domain string `xml:"domain,attr"`
+	Name   string `xml:",chardata"`
+}
+
+const wxrContentNamespace = "http://purl.org/rss/1.0/modules/content/"
+
+// ImportReport describes the result, or for a dry run, the plan, of an import
+type ImportReport struct {
+	DryRun    bool
+	Imported  int
+	Skipped   int
+	Conflicts int
+	Items     []ImportItem
+}
+
+type ImportItem struct {
+	Title  string
+	Type   string
+	Date   time.Time
+	Hidden bool
+	Tags   []string `json:",omitempty"`
+	OldURL string   `json:",omitempty"`
+	File   string   `json:",omitempty"`
+	NewURL string   `json:",omitempty"`
+	Skip   string   `json:",omitempty"`
+}
+
+func (it *wxrItem) encoded(content bool) string {
+	for _, e := range it.Encoded {
+		if (e.XMLName.Space == wxrContentNamespace) == content {
+			return e.Text
+		}
+	}
+	return ""
+}
+
+// date returns the item's publication date. post_date_gmt is left at zero for
+// drafts, so fall back to the local post_date, and then to the RSS pubDate.
+func (it *wxrItem) date() time.Time {
+	if t, err := time.Parse("2006-01-02 15:04:05", strings.TrimSpace(it.DateGMT)); err == nil && t.Year() > 1 {
+		return t
+	}
+	if t, err := time.Parse("2006-01-02 15:04:05", strings.TrimSpace(it.Date)); err == nil && t.Year() > 1 {
+		return t
+	}
+	if t, err := time.Parse(time.RFC1123Z, strings.TrimSpace(it.PubDate)); err == nil {
+		return t
+	}
+	return time.Now()
+}
+
+// post converts an item to a Post
+func (it *wxrItem) post() Post {
+	p := Post{
+		Title:       strings.TrimSpace(it.Title),
+		Description: strings.TrimSpace(it.encoded(false)),
+		Date:        it.date(),
+		Hidden:      it.Status != "publish",
+		Slug:        it.Slug,
+	}
+	p.Lead, p.Content = splitLead(strings.Replace(it.encoded(true), "\r\n", "\n", -1))
+
+	tags := make([]string, 0, len(it.Categories))
+	for _, c := range it.Categories {
+		// "Uncategorized" is WordPress's default, rather than a real tag
+		if (c.Domain == "category" || c.Domain == "post_tag") && c.Name != "Uncategorized" {
+			tags = append(tags, c.Name)
+		}
+	}
+	p.Tags = cleanTags(tags)
+	return p
+}
+
+// oldURLs returns the paths an item was reachable at on the old blog: its
+// permalink, and the "?p=" or "?page_id=" form WordPress always accepts.
+func (it *wxrItem) oldURLs() []string {
+	paths := make([]string, 0, 2)
+	if u, err := url.Parse(strings.TrimSpace(it.Link)); err == nil && u.Path != "" {
+		paths = append(paths, redirectPath(u))
+	}
+	if id := strings.TrimSpace(it.PostID); id != "" {
+		param := "p"
+		if it.Type == "page" {
+			param = "page_id"
+		}
+		u := &url.URL{Path: "/", RawQuery: param + "=" + id}
+		if p := redirectPath(u); len(paths) == 0 || paths[0] != p {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// importWXR imports the posts in a WXR export. A dry run only reports.
+func importWXR(c appengine.Context, r io.Reader, dryRun bool) (ImportReport, error) {
+	report := ImportReport{DryRun: dryRun, Items: make([]ImportItem, 0)}
+
+	export := wxrExport{}
+	if err := xml.NewDecoder(r).Decode(&export); err != nil {
+		return report, fmt.Errorf("Reading export: %v", err)
+	}
+
+	for i := range export.Items {
+		it := &export.Items[i]
+		p := it.post()
+		old := it.oldURLs()
+		item := ImportItem{
+			Title:  p.Title,
+			Type:   it.Type,
+			Date:   p.Date,
+			Hidden: p.Hidden,
+			Tags:   p.Tags,
+		}
+		if len(old) > 0 {
+			item.OldURL = old[0]
+		}
+
+		switch {
+		case it.Type != "post" && it.Type != "page":
+			item.Skip = "Not a post or page"
+		case it.Status == "trash" || it.Status == "auto-draft":
+			item.Skip = "Deleted or unsaved in WordPress"
+		case len(old) > 0:
+			if target, err := getRedirect(c, old[0]); err == nil {
+				item.Skip = "Already imported"
+				item.NewURL = target
+			} else if err != datastore.ErrNoSuchEntity {
+				return report, err
+			}
+		}
+		if item.Skip != "" {
+			report.Skipped++
+			report.Items = append(report.Items, item)
+			continue
+		}
+
+		if !dryRun {
+			// Unlike savePost, imports don't notify Webmention targets or
+			// hubs about years old posts
+			p.Updated = time.Now()
+			k, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Post", nil), &p)
+			if err != nil {
+				return report, err
+			}
+			if err := indexPost(c, k.IntID(), &p); err != nil {
+				return report, err
+			}
+			item.NewURL = "/" + strconv.FormatInt(k.IntID(), 10)
+			for _, path := range old {
+				if err := putRedirect(c, path, item.NewURL); err != nil {
+					return report, err
+				}
+			}
+		}
+		report.Imported++
+		report.Items = append(report.Items, item)
+	}
+
+	if !dryRun && report.Imported > 0 {
+		memcache.Flush(c)
+		expireFeed(c)
+		expireArchives(c)
+	}
+	return report, nil
+}
+
+// AJAX functions
+
+// importPosts imports the WXR export, or markdown file or zip of them,
+// uploaded as "file". With "dryrun" set, nothing is saved. Either way, the
+// report is returned as JSON.
+func importPosts(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	f, h, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "No export file was uploaded: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+
+	// WXR is told apart by its XML declaration
+	dryRun := r.FormValue("dryrun") != ""
+	head := make([]byte, 64)
+	n, _ := io.ReadFull(f, head)
+	if _, err := f.Seek(0, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var report ImportReport
+	if bytes.HasPrefix(bytes.TrimSpace(bytes.TrimPrefix(head[:n], []byte("\xef\xbb\xbf"))), []byte("<?xml")) {
+		report, err = importWXR(c, f, dryRun)
+	} else {
+		var files []markdownFile
+		if files, err = readMarkdownFiles(f, h.Filename); err == nil {
+			report, err = importMarkdown(c, files, dryRun)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
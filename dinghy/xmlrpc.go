@@ -0,0 +1,584 @@
+package dinghy
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ *  XML-RPC support for desktop blogging clients, implementing the MetaWeblog
+ *  API and the few Blogger API methods clients expect alongside it. Clients
+ *  log in with an API token: the username is the token's name, and the
+ *  password is its secret, so each writer should have a token of their own.
+ *
+ *  Post bodies are markdown. "description" holds the whole body, which is
+ *  split into Lead and Content as in the editor, unless the client sends the
+ *  extended entry separately as "mt_text_more". "mt_excerpt" maps to the
+ *  post's Description, and the publish flag is the inverse of Hidden.
+ */
+
+// Single blog installs always report this blog ID
+const xmlrpcBlogID = "1"
+
+// Fault codes, following the HTTP status codes most clients already expect
+const (
+	faultBadRequest   = 400
+	faultUnauthorized = 403
+	faultNotFound     = 404
+	faultServer       = 500
+)
+
+type rpcFault struct {
+	Code    int
+	Message string
+}
+
+func (f *rpcFault) Error() string {
+	return f.Message
+}
+
+type rpcCall struct {
+	XMLName xml.Name   `xml:"methodCall"`
+	Method  string     `xml:"methodName"`
+	Params  []rpcValue `xml:"params>param>value"`
+}
+
+type rpcValue struct {
+	String  *string      `xml:"string"`
+	Int     *string      `xml:"int"`
+	I4      *string      `xml:"i4"`
+	Boolean *string      `xml:"boolean"`
+	Double  *string      `xml:"double"`
+	Date    *string      `xml:"dateTime.iso8601"`
+	Base64  *string      `xml:"base64"`
+	Struct  *[]rpcMember `xml:"struct>member"`
+	Array   *[]rpcValue  `xml:"array>data>value"`
+	Text    string       `xml:",chardata"`
+}
+
+type rpcMember struct {
+	Name  string   `xml:"name"`
+	Value rpcValue `xml:"value"`
+}
+
+// A struct parameter, as decoded from a request
+type rpcStruct map[string]interface{}
+
+func (s rpcStruct) string(name string) string {
+	v, _ := s[name].(string)
+	return v
+}
+
+// decode converts a value to a string, int, bool, float64, time.Time,
+// []byte, []interface{} or rpcStruct. Values with no type are strings.
+func (v *rpcValue) decode() (interface{}, error) {
+	switch {
+	case v.String != nil:
+		return *v.String, nil
+	case v.Int != nil:
+		return strconv.Atoi(strings.TrimSpace(*v.Int))
+	case v.I4 != nil:
+		return strconv.Atoi(strings.TrimSpace(*v.I4))
+	case v.Boolean != nil:
+		return strings.TrimSpace(*v.Boolean) == "1", nil
+	case v.Double != nil:
+		return strconv.ParseFloat(strings.TrimSpace(*v.Double), 64)
+	case v.Date != nil:
+		return parseISO8601(strings.TrimSpace(*v.Date))
+	case v.Base64 != nil:
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(*v.Base64), ""))
+	case v.Struct != nil:
+		s := rpcStruct{}
+		for _, m := range *v.Struct {
+			d, err := m.Value.decode()
+			if err != nil {
+				return nil, err
+			}
+			s[m.Name] = d
+		}
+		return s, nil
+	case v.Array != nil:
+		a := make([]interface{}, 0, len(*v.Array))
+		for i := range *v.Array {
+			d, err := (*v.Array)[i].decode()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, d)
+		}
+		return a, nil
+	}
+	return v.Text, nil
+}
+
+// Clients disagree on the exact date format, so accept the common variants
+func parseISO8601(s string) (time.Time, error) {
+	for _, layout := range []string{
+		"20060102T15:04:05",
+		"20060102T15:04:05Z",
+		"20060102T15:04:05Z07:00",
+		"2006-01-02T15:04:05",
+		"2006-01-02T15:04:05Z07:00",
+		"20060102T150405Z",
+	} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Bad date: %s", s)
+}
+
+// writeValue encodes v as an XML-RPC <value>
+func writeValue(buf *bytes.Buffer, v interface{}) {
+	buf.WriteString("<value>")
+	switch v := v.(type) {
+	case string:
+		buf.WriteString("<string>")
+		xml.EscapeText(buf, []byte(v))
+		buf.WriteString("</string>")
+	case int:
+		fmt.Fprintf(buf, "<int>%d</int>", v)
+	case int64:
+		fmt.Fprintf(buf, "<int>%d</int>", v)
+	case bool:
+		if v {
+			buf.WriteString("<boolean>1</boolean>")
+		} else {
+			buf.WriteString("<boolean>0</boolean>")
+		}
+	case float64:
+		fmt.Fprintf(buf, "<double>%v</double>", v)
+	case time.Time:
+		fmt.Fprintf(buf, "<dateTime.iso8601>%s</dateTime.iso8601>", v.UTC().Format("20060102T15:04:05"))
+	case []byte:
+		fmt.Fprintf(buf, "<base64>%s</base64>", base64.StdEncoding.EncodeToString(v))
+	case rpcStruct:
+		buf.WriteString("<struct>")
+		for name, m := range v {
+			buf.WriteString("<member><name>")
+			xml.EscapeText(buf, []byte(name))
+			buf.WriteString("</name>")
+			writeValue(buf, m)
+			buf.WriteString("</member>")
+		}
+		buf.WriteString("</struct>")
+	case []rpcStruct:
+		buf.WriteString("<array><data>")
+		for _, m := range v {
+			writeValue(buf, m)
+		}
+		buf.WriteString("</data></array>")
+	case []string:
+		buf.WriteString("<array><data>")
+		for _, m := range v {
+			writeValue(buf, m)
+		}
+		buf.WriteString("</data></array>")
+	}
+	buf.WriteString("</value>")
+}
+
+func writeResponse(w http.ResponseWriter, result interface{}, err error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString("<methodResponse>")
+	if err != nil {
+		f, ok := err.(*rpcFault)
+		if !ok {
+			f = &rpcFault{faultServer, err.Error()}
+		}
+		buf.WriteString("<fault>")
+		writeValue(&buf, rpcStruct{"faultCode": f.Code, "faultString": f.Message})
+		buf.WriteString("</fault>")
+	} else {
+		buf.WriteString("<params><param>")
+		writeValue(&buf, result)
+		buf.WriteString("</param></params>")
+	}
+	buf.WriteString("</methodResponse>")
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// rpcArgs reads positional parameters into the given pointers, which may be
+// *string, *int, *bool or *rpcStruct. Integers are accepted for strings, as
+// some clients send post IDs as numbers.
+func rpcArgs(params []interface{}, dst ...interface{}) error {
+	if len(params) < len(dst) {
+		return &rpcFault{faultBadRequest, fmt.Sprintf("Expected %d parameters, got %d", len(dst), len(params))}
+	}
+	for i, d := range dst {
+		ok := true
+		switch d := d.(type) {
+		case *string:
+			switch p := params[i].(type) {
+			case string:
+				*d = p
+			case int:
+				*d = strconv.Itoa(p)
+			default:
+				ok = false
+			}
+		case *int:
+			*d, ok = params[i].(int)
+		case *bool:
+			*d, ok = params[i].(bool)
+		case *rpcStruct:
+			*d, ok = params[i].(rpcStruct)
+		}
+		if !ok {
+			return &rpcFault{faultBadRequest, fmt.Sprintf("Parameter %d has the wrong type", i+1)}
+		}
+	}
+	return nil
+}
+
+// rpcLogin checks a username and password against the API tokens, and
+// returns the caller acting with the token, if their role has the given
+// permission
+func rpcLogin(c appengine.Context, username, password string, perm permission) (caller, error) {
+	t, err := lookupToken(c, password)
+	if err != nil || t.Name != username {
+		return caller{}, &rpcFault{faultUnauthorized, "Invalid username or password"}
+	}
+	cl := tokenCaller(c, t)
+	if !cl.can(perm) {
+		return cl, &rpcFault{faultUnauthorized, "This account does not have permission to " + perm.String()}
+	}
+	return cl, nil
+}
+
+func rpcPostID(s string) (int64, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, &rpcFault{faultNotFound, "No such post"}
+	}
+	return id, nil
+}
+
+func rpcGetPost(c appengine.Context, id int64) (*datastore.Key, Post, error) {
+	p := Post{}
+	k := datastore.NewKey(c, "Post", "", id, nil)
+	err := datastore.Get(c, k, &p)
+	if err == datastore.ErrNoSuchEntity {
+		return k, p, &rpcFault{faultNotFound, "No such post"}
+	}
+	return k, p, err
+}
+
+func toRPCPost(base string, p *Post, id int64) rpcStruct {
+	idStr := strconv.FormatInt(id, 10)
+	link := base + "/" + idStr
+	status := "publish"
+	if p.Hidden {
+		status = "draft"
+	}
+	return rpcStruct{
+		"postid":      idStr,
+		"userid":      "1",
+		"title":       p.Title,
+		"description": p.Lead + p.Content,
+		"mt_excerpt":  p.Description,
+		"dateCreated": p.Date,
+		"link":        link,
+		"permaLink":   link,
+		"post_status": status,
+		"categories":  p.Tags,
+	}
+}
+
+// fromRPCPost copies a client's post struct into p. Fields the client left
+// out keep their current values.
+func fromRPCPost(s rpcStruct, publish bool, p *Post) {
+	if _, ok := s["title"]; ok {
+		p.Title = s.string("title")
+	}
+	if _, ok := s["mt_excerpt"]; ok {
+		p.Description = s.string("mt_excerpt")
+	}
+	if _, ok := s["description"]; ok {
+		if more := s.string("mt_text_more"); more != "" {
+			p.Lead, p.Content = s.string("description"), more
+		} else {
+			p.Lead, p.Content = splitLead(s.string("description"))
+		}
+	}
+	if cats, ok := s["categories"].([]interface{}); ok {
+		tags := make([]string, 0, len(cats))
+		for _, t := range cats {
+			if t, ok := t.(string); ok {
+				tags = append(tags, t)
+			}
+		}
+		p.Tags = cleanTags(tags)
+	}
+	if d, ok := s["dateCreated"].(time.Time); ok && !d.IsZero() {
+		p.Date = d
+	}
+	if p.Date.IsZero() {
+		p.Date = time.Now()
+	}
+	p.Hidden = !publish
+}
+
+// xmlrpc handles "/xmlrpc"
+func xmlrpc(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "XML-RPC requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Base64 makes uploaded media a third larger
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 2*inlineMediaMax))
+	if err != nil {
+		writeResponse(w, nil, &rpcFault{faultBadRequest, err.Error()})
+		return
+	}
+
+	call := rpcCall{}
+	if err := xml.Unmarshal(body, &call); err != nil {
+		writeResponse(w, nil, &rpcFault{faultBadRequest, "Malformed request: " + err.Error()})
+		return
+	}
+
+	params := make([]interface{}, 0, len(call.Params))
+	for i := range call.Params {
+		v, err := call.Params[i].decode()
+		if err != nil {
+			writeResponse(w, nil, &rpcFault{faultBadRequest, err.Error()})
+			return
+		}
+		params = append(params, v)
+	}
+
+	result, err := dispatch(w, r, call.Method, params, c)
+	if err != nil {
+		if _, ok := err.(*rpcFault); !ok {
+			c.Errorf("%s: %v", call.Method, err)
+		}
+	}
+	writeResponse(w, result, err)
+}
+
+var rpcMethods = []string{
+	"blogger.getUsersBlogs",
+	"blogger.deletePost",
+	"metaWeblog.getUsersBlogs",
+	"metaWeblog.newPost",
+	"metaWeblog.editPost",
+	"metaWeblog.getPost",
+	"metaWeblog.getRecentPosts",
+	"metaWeblog.deletePost",
+	"metaWeblog.newMediaObject",
+	"system.listMethods",
+}
+
+func dispatch(w http.ResponseWriter, r *http.Request, method string, params []interface{}, c appengine.Context) (interface{}, error) {
+	var appKey, blogID, postID, username, password string
+
+	switch method {
+	case "system.listMethods":
+		return rpcMethods, nil
+
+	case "blogger.getUsersBlogs", "metaWeblog.getUsersBlogs":
+		if err := rpcArgs(params, &appKey, &username, &password); err != nil {
+			return nil, err
+		}
+		cl, err := rpcLogin(c, username, password, permRead)
+		if err != nil {
+			return nil, err
+		}
+		b, err := getBlogInfo(c)
+		if err != nil {
+			return nil, err
+		}
+		return []rpcStruct{{
+			"blogid":   xmlrpcBlogID,
+			"blogName": b.Title,
+			"url":      siteURL(b, c) + "/",
+			"xmlrpc":   siteURL(b, c) + "/xmlrpc",
+			"isAdmin":  cl.can(permManage),
+		}}, nil
+
+	case "metaWeblog.newPost":
+		var s rpcStruct
+		var publish bool
+		if err := rpcArgs(params, &blogID, &username, &password, &s, &publish); err != nil {
+			return nil, err
+		}
+		cl, err := rpcLogin(c, username, password, permDraft)
+		if err != nil {
+			return nil, err
+		}
+		p := Post{AuthorID: cl.AuthorID}
+		fromRPCPost(s, publish, &p)
+		if err := cl.canSave(nil, &p); err != nil {
+			return nil, &rpcFault{faultUnauthorized, err.Error()}
+		}
+		k, err := savePost(c, datastore.NewIncompleteKey(c, "Post", nil), &p)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.FormatInt(k.IntID(), 10), nil
+
+	case "metaWeblog.editPost":
+		var s rpcStruct
+		var publish bool
+		if err := rpcArgs(params, &postID, &username, &password, &s, &publish); err != nil {
+			return nil, err
+		}
+		cl, err := rpcLogin(c, username, password, permDraft)
+		if err != nil {
+			return nil, err
+		}
+		id, err := rpcPostID(postID)
+		if err != nil {
+			return nil, err
+		}
+		k, p, err := rpcGetPost(c, id)
+		if err != nil {
+			return nil, err
+		}
+		old := p
+		fromRPCPost(s, publish, &p)
+		if err := cl.canSave(&old, &p); err != nil {
+			return nil, &rpcFault{faultUnauthorized, err.Error()}
+		}
+		if _, err := savePost(c, k, &p); err != nil {
+			return nil, err
+		}
+		return true, nil
+
+	case "metaWeblog.getPost":
+		if err := rpcArgs(params, &postID, &username, &password); err != nil {
+			return nil, err
+		}
+		if _, err := rpcLogin(c, username, password, permRead); err != nil {
+			return nil, err
+		}
+		id, err := rpcPostID(postID)
+		if err != nil {
+			return nil, err
+		}
+		_, p, err := rpcGetPost(c, id)
+		if err != nil {
+			return nil, err
+		}
+		base, err := blogURL(c)
+		if err != nil {
+			return nil, err
+		}
+		return toRPCPost(base, &p, id), nil
+
+	case "metaWeblog.getRecentPosts":
+		var num int
+		if err := rpcArgs(params, &blogID, &username, &password, &num); err != nil {
+			return nil, err
+		}
+		if _, err := rpcLogin(c, username, password, permRead); err != nil {
+			return nil, err
+		}
+		if num <= 0 || num > 100 {
+			num = 100
+		}
+		p := make([]Post, 0, num)
+		keys, err := datastore.NewQuery("Post").Order("-Date").Limit(num).GetAll(c, &p)
+		if err != nil {
+			return nil, err
+		}
+		base, err := blogURL(c)
+		if err != nil {
+			return nil, err
+		}
+		posts := make([]rpcStruct, len(p))
+		for i := range p {
+			posts[i] = toRPCPost(base, &p[i], keys[i].IntID())
+		}
+		return posts, nil
+
+	case "blogger.deletePost", "metaWeblog.deletePost":
+		if err := rpcArgs(params, &appKey, &postID, &username, &password); err != nil {
+			return nil, err
+		}
+		cl, err := rpcLogin(c, username, password, permDraft)
+		if err != nil {
+			return nil, err
+		}
+		id, err := rpcPostID(postID)
+		if err != nil {
+			return nil, err
+		}
+		_, p, err := rpcGetPost(c, id)
+		if err != nil {
+			return nil, err
+		}
+		if err := cl.canDelete(&p); err != nil {
+			return nil, &rpcFault{faultUnauthorized, err.Error()}
+		}
+		memcache.Flush(c)
+		if err := removePost(c, id); err != nil {
+			return nil, err
+		}
+		return true, nil
+
+	case "metaWeblog.newMediaObject":
+		var s rpcStruct
+		if err := rpcArgs(params, &blogID, &username, &password, &s); err != nil {
+			return nil, err
+		}
+		if _, err := rpcLogin(c, username, password, permUpload); err != nil {
+			return nil, err
+		}
+		bits, _ := s["bits"].([]byte)
+		m, err := putInlineMedia(c, s.string("name"), s.string("type"), bits)
+		if err == errMediaSize {
+			return nil, &rpcFault{faultBadRequest, err.Error()}
+		} else if err != nil {
+			return nil, err
+		}
+		base, err := blogURL(c)
+		if err != nil {
+			return nil, err
+		}
+		return rpcStruct{"url": base + m.URL}, nil
+	}
+
+	return nil, &rpcFault{faultBadRequest, "Unknown method: " + method}
+}
+
+// rsd describes the XML-RPC endpoint, for clients that discover it from the
+// blog's home page (Really Simple Discovery)
+func rsd(w http.ResponseWriter, r *http.Request) {
+	base, err := blogURL(appengine.NewContext(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/rsd+xml; charset=utf-8")
+	fmt.Fprintf(w, `%s<rsd version="1.0" xmlns="http://archipelago.phrasewise.com/rsd">
+	<service>
+		<engineName>dinghy</engineName>
+		<homePageLink>%[2]s/</homePageLink>
+		<apis>
+			<api name="MetaWeblog" preferred="true" apiLink="%[2]s/xmlrpc" blogID="%[3]s" />
+			<api name="Blogger" preferred="false" apiLink="%[2]s/xmlrpc" blogID="%[3]s" />
+			<api name="Atom" preferred="false" apiLink="%[2]s/atompub" blogID="" />
+		</apis>
+	</service>
+</rsd>
+`, xml.Header, base, xmlrpcBlogID)
+}